@@ -324,8 +324,8 @@ func (e *Endpoint) call(fn *function, msg *Message) {
 		if err != nil {
 			// well, we can't report the problem to the client...
 			e.codec.Close()
-			return
 		}
+		return
 	}
 	reply := reflect.New(fn.reply)
 
@@ -351,8 +351,8 @@ func (e *Endpoint) call(fn *function, msg *Message) {
 			if err != nil {
 				// well, we can't report the problem to the client...
 				e.codec.Close()
-				return
 			}
+			return
 		}
 
 		// then codec fills what it can
@@ -367,8 +367,8 @@ func (e *Endpoint) call(fn *function, msg *Message) {
 				if err != nil {
 					// well, we can't report the problem to the client...
 					e.codec.Close()
-					return
 				}
+				return
 			}
 		}
 	}
@@ -385,8 +385,8 @@ func (e *Endpoint) call(fn *function, msg *Message) {
 		if err2 != nil {
 			// well, we can't report the problem to the client...
 			e.codec.Close()
-			return
 		}
+		return
 	}
 
 	msg.Error = nil
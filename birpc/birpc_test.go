@@ -2,10 +2,13 @@ package birpc_test
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/yinhm/ninepool/birpc"
 	"github.com/yinhm/ninepool/birpc/jsonmsg"
 	"io"
 	"net"
+	"reflect"
 	"testing"
 )
 
@@ -30,6 +33,10 @@ func (_ WordLength) Len(request *Request, reply *Reply) error {
 	return nil
 }
 
+func (_ WordLength) Fail(request *Request, reply *Reply) error {
+	return &birpc.Error{Code: 20, Msg: "failed on " + request.Word}
+}
+
 // this is here only to trigger a bug where all methods are thought to
 // be rpc methods
 func (_ WordLength) redHerring() {
@@ -116,6 +123,44 @@ func TestClient(t *testing.T) {
 	}
 }
 
+func TestClientError(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	registry := makeRegistry()
+	server := birpc.NewEndpoint(jsonmsg.NewCodec(s), registry)
+	server_err := make(chan error)
+	go func() {
+		server_err <- server.Serve()
+	}()
+
+	client := birpc.NewEndpoint(jsonmsg.NewCodec(c), nil)
+	client_err := make(chan error)
+	go func() {
+		client_err <- client.Serve()
+	}()
+
+	// error response must be the only response, endpoint keeps serving
+	for i := 0; i < 2; i++ {
+		err := client.Call("WordLength.Fail", &Request{"xyzzy"}, &Reply{})
+		rerr, ok := err.(*birpc.Error)
+		if !ok || rerr.Code != 20 {
+			t.Fatalf("unexpected error from call: %v", err)
+		}
+	}
+
+	c.Close()
+
+	err := <-server_err
+	if err != io.EOF {
+		t.Fatalf("unexpected error from peer ServeCodec: %v", err)
+	}
+
+	err = <-client_err
+	if err != io.ErrClosedPipe {
+		t.Fatalf("unexpected error from local ServeCodec: %v", err)
+	}
+}
+
 func TestClientNilResult(t *testing.T) {
 	c, s := net.Pipe()
 	defer c.Close()
@@ -208,3 +253,46 @@ func TestServerEndpointArg(t *testing.T) {
 		t.Fatalf("peer never saw a birpc.Endpoint")
 	}
 }
+
+// failFiller is a codec failing to fill extra args.
+type failFiller struct {
+	birpc.Codec
+}
+
+func (failFiller) FillArgs([]reflect.Value) error {
+	return errors.New("fill failed")
+}
+
+type Unreachable struct{}
+
+func (_ Unreachable) Poke(request *nothing, reply *nothing, endpoint *birpc.Endpoint) error {
+	return nil
+}
+
+func TestServerFillArgsError(t *testing.T) {
+	registry := birpc.NewRegistry()
+	registry.RegisterService(Unreachable{})
+
+	c, s := net.Pipe()
+	defer c.Close()
+
+	server := birpc.NewEndpoint(failFiller{jsonmsg.NewCodec(s)}, registry)
+	go server.Serve()
+
+	// error response must be the only response of each call
+	dec := json.NewDecoder(c)
+	for id := uint64(1); id <= 2; id++ {
+		go fmt.Fprintf(c, `{"id":%d,"method":"Unreachable.Poke","params":{}}`+"\n", id)
+
+		var reply struct {
+			Id    uint64        `json:"id"`
+			Error []interface{} `json:"error"`
+		}
+		if err := dec.Decode(&reply); err != nil {
+			t.Fatalf("decode failed: %s", err)
+		}
+		if reply.Id != id || len(reply.Error) < 2 || reply.Error[1] != "fill failed" {
+			t.Fatalf("expected error response of call %d: %#v", id, reply)
+		}
+	}
+}
@@ -54,17 +54,17 @@ function connect() {
 	var rpc = JSON.parse(e.data);
 	console.log("rpc in:", rpc);
 
-	if (rpc.fn === undefined
-	    || rpc.fn == "") {
+	if (rpc.method === undefined
+	    || rpc.method == "") {
 	    // responses; we're currently ignoring errors
 	    return;
 	}
 
 	// kludge dispatch for now
-	if (rpc.fn != "Chat.Message") {
+	if (rpc.method != "Chat.Message") {
 	    rpc.error = {rpc: "No such function."};
-	    delete rpc.fn;
-	    delete rpc.args;
+	    delete rpc.method;
+	    delete rpc.params;
 	    delete rpc.result;
 	    ws.send(rpc)
 	    return;
@@ -76,23 +76,23 @@ function connect() {
 
 	var time = document.createElement("span");
 	time.setAttribute("class", "time");
-	time.appendChild(document.createTextNode(rpc.args.time));
+	time.appendChild(document.createTextNode(rpc.params.time));
 	line.appendChild(time);
 
 	var from = document.createElement("span");
 	from.setAttribute("class", "from");
-	from.appendChild(document.createTextNode(rpc.args.from));
+	from.appendChild(document.createTextNode(rpc.params.from));
 	line.appendChild(from);
 
 	var text = document.createElement("span");
 	text.setAttribute("class", "message");
-	text.appendChild(document.createTextNode(rpc.args.message));
+	text.appendChild(document.createTextNode(rpc.params.message));
 	line.appendChild(text);
 
 	div.appendChild(line);
 
-	delete rpc.fn;
-	delete rpc.args;
+	delete rpc.method;
+	delete rpc.params;
 	rpc.result = {};
 	delete rpc.error;
 	console.log("rpc out:", rpc);
@@ -121,9 +121,9 @@ function init() {
 function send() {
     var rpc = {
 	// TODO
-	id: "0",
-	fn: "Chat.Message",
-	args: {
+	id: 0,
+	method: "Chat.Message",
+	params: {
 	    from: document.msgform.name.value,
 	    message: document.msgform.message.value
 	}
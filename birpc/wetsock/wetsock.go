@@ -18,11 +18,11 @@ type codec struct {
 // can embed birpc.Message and just override the two fields I need to
 // change.
 type jsonMessage struct {
-	ID     uint64          `json:"id,string,omitempty"`
-	Func   string          `json:"fn,omitempty"`
-	Args   json.RawMessage `json:"args,omitempty"`
-	Result json.RawMessage `json:"result,omitempty"`
-	Error  *birpc.Error    `json:"error"`
+	ID     uint64           `json:"id,omitempty"`
+	Func   string           `json:"method,omitempty"`
+	Args   json.RawMessage  `json:"params,omitempty"`
+	Result json.RawMessage  `json:"result,omitempty"`
+	Error  *json.RawMessage `json:"error"`
 }
 
 func (c *codec) ReadMessage(msg *birpc.Message) error {
@@ -35,7 +35,14 @@ func (c *codec) ReadMessage(msg *birpc.Message) error {
 	msg.Func = jm.Func
 	msg.Args = jm.Args
 	msg.Result = jm.Result
-	msg.Error = jm.Error
+	if jm.Error != nil {
+		rerr := &birpc.Error{}
+		err = c.UnmarshalError(jm.Error, rerr)
+		if err != nil {
+			return err
+		}
+		msg.Error = rerr
+	}
 	return nil
 }
 
@@ -65,6 +72,14 @@ func (c *codec) UnmarshalResult(msg *birpc.Message, result interface{}) error {
 	return err
 }
 
+// Errors are sent as JSON objects by WriteMessage, see birpc.Error.
+func (c *codec) UnmarshalError(raw *json.RawMessage, rerr *birpc.Error) error {
+	if raw == nil {
+		return nil
+	}
+	return json.Unmarshal([]byte(*raw), rerr)
+}
+
 func (c *codec) FillArgs(arglist []reflect.Value) error {
 	for i := 0; i < len(arglist); i++ {
 		switch arglist[i].Interface().(type) {
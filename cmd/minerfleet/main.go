@@ -0,0 +1,97 @@
+// Command minerfleet load tests the proxy with simulated miners. Every
+// miner subscribes, authorizes and submits valid shares found by hashing
+// jobs on CPU at its hashrate, accept ratio and submit latency of the
+// fleet are reported.
+//
+//	minerfleet -addr 127.0.0.1:3333 -miners 20 -hashrate 50000 -duration 5m
+package main
+
+import (
+	"flag"
+	"github.com/yinhm/ninepool/stratum"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:3333", "Address of proxy")
+	miners := flag.Int("miners", 10, "Miners simulated")
+	hashrate := flag.Float64("hashrate", 50000, "Hashrate of a miner, in H/s")
+	difficulty := flag.Float64("diff", stratum.DefaultMinDifficulty, "Difficulty suggested, 0 to leave to proxy")
+	address := flag.String("address", "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda", "Payout address miners authorize with")
+	algorithm := flag.String("algorithm", stratum.SHA256.Name, "Algorithm of proxy listener")
+	duration := flag.Duration("duration", 0, "Duration of test, 0 until interrupted")
+	ramp := flag.Duration("ramp", time.Duration(10)*time.Millisecond, "Interval between miners connecting")
+	interval := flag.Duration("report", time.Duration(10)*time.Second, "Interval of reports")
+	flag.Parse()
+
+	algo, err := stratum.FindAlgorithm(*algorithm)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt)
+		var timeout <-chan time.Time
+		if *duration > 0 {
+			timeout = time.After(*duration)
+		}
+		select {
+		case <-sigCh:
+		case <-timeout:
+		}
+		close(done)
+	}()
+
+	stats := NewStats()
+	var wg sync.WaitGroup
+	for i := 1; i <= *miners && !closed(done); i++ {
+		miner := &Miner{
+			Id:         i,
+			Username:   *address + ".sim" + strconv.Itoa(i),
+			Hashrate:   *hashrate,
+			Difficulty: *difficulty,
+			Algorithm:  algo,
+			stats:      stats,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := miner.Run(*addr, done); err != nil {
+				log.Printf("[Fleet] miner #%d stopped: %s", miner.Id, err)
+			}
+		}()
+		select {
+		case <-done:
+		case <-time.After(*ramp):
+		}
+	}
+	log.Printf("[Fleet] %d miners started on %s at %.0f H/s each.", *miners, *addr, *hashrate)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for !closed(done) {
+		select {
+		case <-ticker.C:
+			log.Printf("[Fleet] %s", stats.Report())
+		case <-done:
+		}
+	}
+	wg.Wait()
+	log.Printf("[Fleet] done:\n%s", stats.Report())
+}
+
+func closed(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"github.com/conformal/btcwire"
+	"github.com/yinhm/ninepool/birpc"
+	"github.com/yinhm/ninepool/stratum"
+	"net"
+	"time"
+)
+
+// Hashing is throttled to hashrate in ticks.
+const hashTick = time.Duration(100) * time.Millisecond
+
+// Miner is a simulated miner hashing jobs of proxy on CPU.
+type Miner struct {
+	Id         int
+	Username   string
+	Hashrate   float64 // hashes per second
+	Difficulty float64 // suggested to proxy, 0 never suggested
+	Algorithm  *stratum.Algorithm
+
+	stats  *Stats
+	client *stratum.StratumClient
+}
+
+// work is header of a job on an extranonce2, nonce rolled on it.
+type work struct {
+	job         *stratum.Job
+	extraNonce2 string
+	header      *btcwire.BlockHeader
+	nonce       uint32
+}
+
+// Run connects to proxy at addr and mines until done closed or connection
+// lost.
+func (m *Miner) Run(addr string, done <-chan struct{}) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	errch := make(chan error, 1)
+	m.client = stratum.NewClient(conn, errch)
+	defer m.client.Close()
+
+	if err := m.client.Subscribe(); err != nil {
+		return err
+	}
+	if err := m.client.Authorize(m.Username, "x"); err != nil {
+		return err
+	}
+	if m.Difficulty > 0 {
+		if err := m.client.SuggestDifficulty(m.Difficulty); err != nil {
+			return err
+		}
+	}
+
+	ctx := m.client.Context()
+	ticker := time.NewTicker(hashTick)
+	defer ticker.Stop()
+	var w *work
+	var extraNonce2 uint64
+	carry := 0.0
+	for {
+		select {
+		case <-done:
+			return nil
+		case err := <-errch:
+			return err
+		case job := <-ctx.JobCh:
+			extraNonce2 += 1
+			w, err = m.newWork(job, ctx, extraNonce2)
+			if err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if w == nil {
+				continue
+			}
+			carry += m.Hashrate * hashTick.Seconds()
+			count := uint64(carry)
+			carry -= float64(count)
+			if err := m.hash(w, count, ctx.Difficulty()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *Miner) newWork(job *stratum.Job, ctx *stratum.ClientContext, extraNonce2 uint64) (*work, error) {
+	size := uint(ctx.ExtraNonce2Size)
+	if size < 8 {
+		extraNonce2 &= 1<<(size*8) - 1
+	}
+	w := &work{
+		job:         job,
+		extraNonce2: fmt.Sprintf("%0*x", size*2, extraNonce2),
+	}
+	merkleRoot := job.MerkleRoot(ctx.ExtraNonce1, w.extraNonce2)
+	header, err := stratum.SerializeHeader(job, merkleRoot, job.Ntime, "00000000")
+	if err != nil {
+		return nil, err
+	}
+	w.header = header
+	return w, nil
+}
+
+// hash rolls count nonces on work, shares found are submitted.
+func (m *Miner) hash(w *work, count uint64, difficulty float64) error {
+	if difficulty <= 0 {
+		difficulty = 1
+	}
+	target := m.Algorithm.Target(difficulty)
+	for i := uint64(0); i < count; i++ {
+		w.header.Nonce = w.nonce
+		hash, err := m.Algorithm.HashHeader(w.header)
+		if err != nil {
+			return err
+		}
+		if stratum.ShaHashToBig(hash).Cmp(target) <= 0 {
+			go m.submit(w.job, w.extraNonce2, fmt.Sprintf("%08x", w.nonce))
+		}
+		w.nonce += 1
+	}
+	m.stats.addHashes(count)
+	return nil
+}
+
+func (m *Miner) submit(job *stratum.Job, extraNonce2, nonce string) {
+	started := time.Now()
+	err := m.client.Submit(m.Username, job.JobId, extraNonce2, job.Ntime, nonce)
+	latency := time.Since(started)
+	switch e := err.(type) {
+	case nil:
+		m.stats.addShare(latency, "")
+	case *birpc.Error:
+		m.stats.addShare(latency, e.Msg)
+	default:
+		m.stats.addShare(latency, err.Error())
+	}
+}
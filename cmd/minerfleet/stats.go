@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stats of shares submitted by fleet.
+type Stats struct {
+	lock      sync.Mutex
+	started   time.Time
+	hashes    uint64
+	accepted  int
+	rejected  int
+	reasons   map[string]int // rejected shares by reason
+	latencies []time.Duration
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		started: time.Now(),
+		reasons: make(map[string]int),
+	}
+}
+
+func (s *Stats) addHashes(count uint64) {
+	s.lock.Lock()
+	s.hashes += count
+	s.lock.Unlock()
+}
+
+// addShare records share submitted, reason is empty if accepted.
+func (s *Stats) addShare(latency time.Duration, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if reason == "" {
+		s.accepted += 1
+	} else {
+		s.rejected += 1
+		s.reasons[reason] += 1
+	}
+	s.latencies = append(s.latencies, latency)
+}
+
+// percentile of sorted latencies, p in 0-100.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+// Report returns summary of stats.
+func (s *Stats) Report() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	elapsed := time.Since(s.started).Seconds()
+	total := s.accepted + s.rejected
+	ratio := 0.0
+	if total > 0 {
+		ratio = float64(s.accepted) / float64(total) * 100
+	}
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	lines := []string{
+		fmt.Sprintf("hashrate %.0f H/s, shares %d, accepted %d (%.1f%%), rejected %d",
+			float64(s.hashes)/elapsed, total, s.accepted, ratio, s.rejected),
+		fmt.Sprintf("latency p50 %s, p90 %s, p99 %s, max %s",
+			percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99), percentile(sorted, 100)),
+	}
+	reasons := make([]string, 0, len(s.reasons))
+	for reason := range s.reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		lines = append(lines, fmt.Sprintf("rejected %d: %s", s.reasons[reason], reason))
+	}
+	return strings.Join(lines, "\n")
+}
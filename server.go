@@ -3,15 +3,9 @@ package main
 import (
 	"github.com/yinhm/ninepool/stratum"
 	"log"
-	"net"
 	"os"
 )
 
-const (
-	network = "tcp4"
-	addr    = ":3335"
-)
-
 func main() {
 	options, err := stratum.ParseCommandLine()
 	if err != nil {
@@ -19,16 +13,18 @@ func main() {
 		return
 	}
 
-	ln, err := net.Listen(network, addr)
-	if err != nil {
-		panic(err)
+	listeners := make([]*stratum.Listener, 0, len(options.Listeners))
+	for _, lo := range options.Listeners {
+		ln, err := stratum.Listen(lo)
+		if err != nil {
+			panic(err)
+		}
+		defer ln.Close()
+		listeners = append(listeners, ln)
 	}
-	defer ln.Close()
-
-	log.Printf("Listen on %s", addr)
 
 	service := stratum.NewStratumServer(options)
-	if err := service.Start(ln); err != nil {
+	if err := service.Start(listeners...); err != nil {
 		log.Printf("Service exited with error: %s\n", err)
 		os.Exit(255)
 	} else {
@@ -0,0 +1,79 @@
+package stratum
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/conformal/btcwire"
+	"math/big"
+)
+
+// Algorithm is the proof of work of a coin. Shares are hashed and checked
+// against difficulty by the algorithm of listener they submitted to.
+type Algorithm struct {
+	Name string
+
+	// Target of difficulty 1, see DIFF1 in TODO.md.
+	Diff1 *big.Int
+
+	// Proof of work hash of serialized block header, in the same byte order
+	// as btcwire.ShaHash.
+	PowHash func(header []byte) []byte
+}
+
+var algorithms = make(map[string]*Algorithm)
+
+// RegisterAlgorithm makes algorithm available to listeners, algorithms
+// depending on libmultihashing registered only when built with
+// -tags multihash.
+func RegisterAlgorithm(algo *Algorithm) {
+	algorithms[algo.Name] = algo
+}
+
+func FindAlgorithm(name string) (*Algorithm, error) {
+	algo, ok := algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("Algorithm %s not supported.", name)
+	}
+	return algo, nil
+}
+
+// Target of share difficulty, fractional difficulty supported.
+func (algo *Algorithm) Target(diff float64) *big.Int {
+	diff1 := new(big.Float).SetInt(algo.Diff1)
+	target, _ := new(big.Float).Quo(diff1, big.NewFloat(diff)).Int(nil)
+	return target
+}
+
+func (algo *Algorithm) Difficulty(target *big.Int) float64 {
+	diff1 := new(big.Float).SetInt(algo.Diff1)
+	diff, _ := new(big.Float).Quo(diff1, new(big.Float).SetInt(target)).Float64()
+	return diff
+}
+
+// HashesPerShare is the expected hashes to find a share of difficulty 1.
+func (algo *Algorithm) HashesPerShare() float64 {
+	space := new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(1), 256))
+	diff1 := new(big.Float).SetInt(new(big.Int).Add(algo.Diff1, big.NewInt(1)))
+	hashes, _ := new(big.Float).Quo(space, diff1).Float64()
+	return hashes
+}
+
+// HashHeader returns proof of work hash of block header.
+func (algo *Algorithm) HashHeader(header *btcwire.BlockHeader) (*btcwire.ShaHash, error) {
+	var buf bytes.Buffer
+	err := header.Serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return btcwire.NewShaHash(algo.PowHash(buf.Bytes()))
+}
+
+var SHA256 = &Algorithm{
+	Name:    "sha256",
+	Diff1:   CompactToBig(0x1d00ffff),
+	PowHash: btcwire.DoubleSha256,
+}
+
+func init() {
+	RegisterAlgorithm(SHA256)
+}
@@ -0,0 +1,43 @@
+//go:build multihash
+// +build multihash
+
+package stratum
+
+/*
+#cgo CFLAGS: -I${SRCDIR}/../lib
+#cgo LDFLAGS: ${SRCDIR}/../lib/libmultihashing.a
+
+#include <stdint.h>
+#include <x11.h>
+
+void scrypt_N_R_1_256(const char* input, char* output, uint32_t N, uint32_t R, uint32_t len);
+*/
+import "C"
+import "unsafe"
+
+func x11Hash(header []byte) []byte {
+	output := make([]byte, 32)
+	C.x11_hash((*C.char)(unsafe.Pointer(&header[0])),
+		(*C.char)(unsafe.Pointer(&output[0])), C.uint32_t(len(header)))
+	return output
+}
+
+func scryptHash(header []byte) []byte {
+	output := make([]byte, 32)
+	C.scrypt_N_R_1_256((*C.char)(unsafe.Pointer(&header[0])),
+		(*C.char)(unsafe.Pointer(&output[0])), 1024, 1, C.uint32_t(len(header)))
+	return output
+}
+
+func init() {
+	RegisterAlgorithm(&Algorithm{
+		Name:    "scrypt",
+		Diff1:   CompactToBig(0x1f00ffff),
+		PowHash: scryptHash,
+	})
+	RegisterAlgorithm(&Algorithm{
+		Name:    "x11",
+		Diff1:   CompactToBig(0x1d00ffff),
+		PowHash: x11Hash,
+	})
+}
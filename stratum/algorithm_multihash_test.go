@@ -0,0 +1,33 @@
+//go:build multihash
+// +build multihash
+
+package stratum_test
+
+import (
+	"encoding/hex"
+	"github.com/conformal/btcwire"
+	"github.com/yinhm/ninepool/stratum"
+	"testing"
+)
+
+// litecoin genesis block header
+const LTC_GENESIS = "01000000000000000000000000000000000000000000000000000000000000000000000" +
+	"0d9ced4ed1130f7b7faad9be25323ffafa33232a17c3edf6cfd97bee6bafbdd97b9aa8e4ef0ff0f1ecd513f7c"
+
+func TestScrypt(t *testing.T) {
+	algo, err := stratum.FindAlgorithm("scrypt")
+	if err != nil {
+		t.Fatalf("scrypt not registered: %s", err)
+	}
+
+	raw, _ := hex.DecodeString(LTC_GENESIS)
+	hash, err := btcwire.NewShaHash(algo.PowHash(raw))
+	if err != nil {
+		t.Fatalf("Failed to hash header: %s", err)
+	}
+
+	expected := "0000050c34a64b415b6b15b37f2216634b5b1669cb9a2e38d76f7213b0671e00"
+	if hash.String() != expected {
+		t.Fatalf("Unexpected scrypt hash %s", hash)
+	}
+}
@@ -0,0 +1,92 @@
+package stratum
+
+import (
+	"log"
+	"time"
+)
+
+// autoBid returns true if order escalates its price, it has a target
+// hashrate and room under max price.
+func (od *Order) autoBid() bool {
+	return od.TargetHashrate > 0 && od.PriceStep > 0 && od.MaxPrice > od.price()
+}
+
+// raisePrice raises price by step up to max price, returns prices before
+// and after.
+func (od *Order) raisePrice() (old, price uint64) {
+	od.lock.Lock()
+	defer od.lock.Unlock()
+	old = od.Price
+	od.Price += od.PriceStep
+	if od.Price > od.MaxPrice {
+		od.Price = od.MaxPrice
+	}
+	return old, od.Price
+}
+
+// outbid returns true if a pool of higher price on algorithm of order has
+// workers, called with server locked.
+func (s *StratumServer) outbid(order *Order) bool {
+	for _, pool := range s.pools {
+		if pool.order.price() > order.price() && pool.algorithm() == order.algorithm() &&
+			pool.isAvailable() && pool.workerCount() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AutoBid raises price of orders by step up to max price, if order got less
+// than target hashrate for auto bid period while workers are taken by
+// higher bids, workers of cheaper pools are asked to reconnect to orders
+// raised. Called periodically by server.
+func (s *StratumServer) AutoBid(now time.Time) {
+	raised := make([]*Pool, 0)
+	s.lock.Lock()
+
+	period := s.options.AutoBidPeriod
+	for _, order := range s.orders {
+		// paused, banned, dead or closed orders can not take workers
+		pool, ok := s.pools[order.Id]
+		if !order.autoBid() || !ok || !pool.isAvailable() {
+			order.starved = time.Time{}
+			continue
+		}
+		if order.Hashrate().EMA >= order.TargetHashrate || !s.outbid(order) {
+			order.starved = time.Time{}
+			continue
+		}
+		if order.starved.IsZero() {
+			order.starved = now
+			continue
+		}
+		if now.Sub(order.starved) < period {
+			continue
+		}
+
+		old, price := order.raisePrice()
+		order.starved = now
+		raised = append(raised, pool)
+		log.Printf("[Order] #%d outbid, price raised %d -> %d.", order.Id, old, price)
+		publishEvent(EventOrderPrice, &OrderPriceEvent{order.Id, old, price})
+	}
+	s.lock.Unlock()
+
+	for _, pool := range raised {
+		s.reacquireWorkers(pool)
+	}
+}
+
+func (s *StratumServer) autoBidLoop() {
+	ticker := time.NewTicker(AutoBidInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.lock.Lock()
+		closing := s.closing
+		s.lock.Unlock()
+		if closing {
+			return
+		}
+		s.AutoBid(now)
+	}
+}
@@ -0,0 +1,77 @@
+package stratum
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// BanList rejects workers by remote ip, network in CIDR notation, or payout
+// address in username.
+type BanList struct {
+	ips       map[string]bool
+	networks  []*net.IPNet
+	addresses map[string]bool
+}
+
+func NewBanList(entries []string) (*BanList, error) {
+	bans := &BanList{
+		ips:       make(map[string]bool),
+		addresses: make(map[string]bool),
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			return nil, fmt.Errorf("Empty ban entry.")
+		case strings.Contains(entry, "/"):
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ban network: %s", entry)
+			}
+			bans.networks = append(bans.networks, network)
+		case net.ParseIP(entry) != nil:
+			bans.ips[net.ParseIP(entry).String()] = true
+		default:
+			bans.addresses[entry] = true
+		}
+	}
+	return bans, nil
+}
+
+// BannedAddr tests remote address of connection, addresses without ip like
+// net.Pipe are never banned.
+func (b *BanList) BannedAddr(addr net.Addr) bool {
+	if b == nil || addr == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if b.ips[ip.String()] {
+		return true
+	}
+	for _, network := range b.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// BannedAddress tests payout address of worker.
+func (b *BanList) BannedAddress(address string) bool {
+	return b != nil && b.addresses[address]
+}
+
+func (b *BanList) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.ips) + len(b.networks) + len(b.addresses)
+}
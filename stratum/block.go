@@ -0,0 +1,69 @@
+package stratum
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/conformal/btcwire"
+	"log"
+	"math/big"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Recent block candidates kept in memory by server.
+const MaxBlockCandidates = 100
+
+// BlockCandidate is a share meeting the network target of job, might be a
+// block found for upstream pool.
+type BlockCandidate struct {
+	OrderId       uint64
+	Worker        string
+	JobId         string
+	UpstreamJobId string
+	Nbits         string
+	Hash          string
+	Header        string // serialized block header in hex
+	Created       time.Time
+}
+
+// BlockNotifier called on every block candidate found.
+type BlockNotifier func(*BlockCandidate)
+
+func NewBlockCandidate(pool *Pool, job *Job, worker string, header *btcwire.BlockHeader) *BlockCandidate {
+	var buf bytes.Buffer
+	header.Serialize(&buf)
+	hash, _ := header.BlockSha()
+
+	return &BlockCandidate{
+		OrderId:       pool.id,
+		Worker:        worker,
+		JobId:         job.JobId,
+		UpstreamJobId: job.UpstreamJobId,
+		Nbits:         job.Nbits,
+		Hash:          hash.String(),
+		Header:        hex.EncodeToString(buf.Bytes()),
+		Created:       time.Now(),
+	}
+}
+
+// isBlockCandidate tests proof of work hash against job network target.
+func isBlockCandidate(job *Job, powHash *big.Int) bool {
+	bits, err := HexToUint32(job.Nbits)
+	if err != nil {
+		return false
+	}
+	return powHash.Cmp(CompactToBig(bits)) <= 0
+}
+
+// BlockNotifyCommand returns a notifier executing shell command like
+// bitcoind's -blocknotify, %s in command is replaced by block hash.
+func BlockNotifyCommand(command string) BlockNotifier {
+	return func(block *BlockCandidate) {
+		cmdline := strings.Replace(command, "%s", block.Hash, -1)
+		out, err := exec.Command("sh", "-c", cmdline).CombinedOutput()
+		if err != nil {
+			log.Printf("[Block] notify command failed: %s, %s", err, out)
+		}
+	}
+}
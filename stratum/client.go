@@ -2,14 +2,36 @@ package stratum
 
 import (
 	"errors"
+	"fmt"
 	"github.com/tv42/topic"
 	"github.com/yinhm/ninepool/birpc"
 	"github.com/yinhm/ninepool/birpc/jsonmsg"
 	"io"
 	"log"
 	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
 )
 
+var (
+	ErrShareRejected = errors.New("Share rejected.")
+	ErrCallTimeout   = errors.New("Call timeout.")
+	ErrConnClosed    = errors.New("Connection closed.")
+	ErrAuthRejected  = errors.New("Authorization rejected.")
+)
+
+// AuthError is authorization not completed for connection failure, not a
+// rejection of credentials.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return "Authorization failed: " + e.Err.Error()
+}
+
 func NewClient(conn net.Conn, errch chan error) *StratumClient {
 	c := NewStratumClient()
 	defer c.close()
@@ -29,11 +51,125 @@ type ClientContext struct {
 	Authorized      bool
 	ExtraNonce1     string
 	ExtraNonce2Size int
-	PrevDifficulty  float64
-	Difficulty      float64
+	VersionMask     uint32 // version rolling mask, 0 if not negotiated, guarded by lock
 	RemoteAddress   string
+	Message         string // last client.show_message from server
 	JobCh           chan *Job
 	ShutdownCh      chan bool
+
+	lock           sync.Mutex // guards redirect, difficulty and version mask, set on RPC goroutine
+	redirectHost   string     // of client.reconnect, empty for same host
+	redirectPort   string     // of client.reconnect, empty for same port
+	prevDifficulty float64
+	difficulty     float64 // of mining.set_difficulty
+}
+
+// Redirect returns host and port pool asked to reconnect to by
+// client.reconnect, empty for same.
+func (ctx *ClientContext) Redirect() (host, port string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.redirectHost, ctx.redirectPort
+}
+
+// Difficulty returns difficulty last set by pool, safe to call while
+// notifications of pool are handled.
+func (ctx *ClientContext) Difficulty() float64 {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.difficulty
+}
+
+// versionMask returns version rolling mask last set by pool.
+func (ctx *ClientContext) versionMask() uint32 {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.VersionMask
+}
+
+func (ctx *ClientContext) setVersionMask(mask uint32) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.VersionMask = mask
+}
+
+// setPool links context to pool of id, upstream notifications of pool
+// reach its workers.
+func (ctx *ClientContext) setPool(pid uint64) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.pid = pid
+}
+
+// pool returns pool of context, false if not linked.
+func (ctx *ClientContext) pool() (*Pool, bool) {
+	ctx.lock.Lock()
+	pid := ctx.pid
+	ctx.lock.Unlock()
+	if pid == 0 || DefaultServer == nil {
+		return nil, false
+	}
+	return DefaultServer.findPool(pid)
+}
+
+func (ctx *ClientContext) setRedirect(host, port string) {
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.redirectHost = host
+	ctx.redirectPort = port
+}
+
+// Client service, methods called by stratum server on client.
+type Client struct{}
+
+func (c *Client) Get_version(args *interface{}, reply *string) error {
+	*reply = Version
+	return nil
+}
+
+func (c *Client) Show_message(args *interface{}, reply *interface{}, e *birpc.Endpoint) error {
+	params, ok := (*args).([]interface{})
+	if !ok || len(params) < 1 {
+		return nil
+	}
+	ctx := e.Context.(*ClientContext)
+	ctx.Message, _ = params[0].(string)
+	log.Printf("client.show_message: %s", ctx.Message)
+	return nil
+}
+
+// Reconnect handles client.reconnect of pool, connection is closed after
+// wait seconds, pool reconnects to host and port given.
+func (c *Client) Reconnect(args *interface{}, reply *interface{}, e *birpc.Endpoint) error {
+	params, _ := (*args).([]interface{})
+	ctx := e.Context.(*ClientContext)
+	wait := 0
+	host, port := "", ""
+	if len(params) > 0 {
+		host, _ = params[0].(string)
+	}
+	if len(params) > 1 {
+		switch value := params[1].(type) {
+		case float64:
+			if value > 0 {
+				port = strconv.Itoa(int(value))
+			}
+		case string:
+			port = value
+		}
+	}
+	if len(params) > 2 {
+		if seconds, ok := params[2].(float64); ok && seconds > 0 {
+			wait = int(seconds)
+		}
+	}
+	ctx.setRedirect(host, port)
+	log.Printf("client.reconnect to %s:%s in %d seconds", host, port, wait)
+	go func() {
+		time.Sleep(time.Duration(wait) * time.Second)
+		e.Close()
+	}()
+	return nil
 }
 
 type StratumClient struct {
@@ -41,6 +177,8 @@ type StratumClient struct {
 	endpoint *birpc.Endpoint
 	context  *ClientContext
 	Active   bool
+	Timeout  time.Duration // of configure, subscribe and authorize, 0 waits forever
+	done     chan struct{} // closed when connection lost
 }
 
 func NewStratumClient() *StratumClient {
@@ -54,6 +192,7 @@ func NewStratumClient() *StratumClient {
 	mining := &Mining{}
 	// sc.registry.RegisterService(sc)
 	sc.registry.RegisterService(mining)
+	sc.registry.RegisterService(&Client{})
 	return sc
 }
 
@@ -63,8 +202,10 @@ func (c *StratumClient) Serve(conn io.ReadWriteCloser, errch chan error) {
 		JobCh:      make(chan *Job, 1),
 		ShutdownCh: make(chan bool, 1),
 	}
+	c.done = make(chan struct{})
 	go func() {
 		err := c.endpoint.Serve()
+		close(c.done)
 		if err != nil {
 			errch <- err
 		}
@@ -79,10 +220,38 @@ func (c *StratumClient) Context() *ClientContext {
 	return c.endpoint.Context.(*ClientContext)
 }
 
+// call calls method on peer, gives up when connection lost, or after
+// Timeout if set. Endpoint never fails pending calls itself.
+func (c *StratumClient) call(method string, args, reply interface{}) error {
+	return c.callTimeout(method, args, reply, c.Timeout)
+}
+
+// callTimeout is call giving up after timeout given, 0 waits forever.
+func (c *StratumClient) callTimeout(method string, args, reply interface{}, limit time.Duration) error {
+	var timeout <-chan time.Time
+	if limit > 0 {
+		timeout = time.After(limit)
+	}
+	call := c.endpoint.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-c.done:
+		select {
+		case <-call.Done:
+			return call.Error
+		default:
+			return ErrConnClosed
+		}
+	case <-timeout:
+		return ErrCallTimeout
+	}
+}
+
 func (c *StratumClient) Subscribe() (err error) {
 	args := birpc.List{}
 	reply := &birpc.List{}
-	err = c.endpoint.Call("mining.subscribe", args, reply)
+	err = c.call("mining.subscribe", args, reply)
 
 	if err != nil {
 		return err
@@ -108,23 +277,97 @@ func (c *StratumClient) Subscribe() (err error) {
 	return nil
 }
 
+// Configure negotiates BIP310 version rolling, mask is the bits we would
+// like to roll. An error reply means the peer knows nothing about
+// mining.configure, which is not fatal, version rolling stays disabled.
+// Some pools never reply to unknown methods, give up after ConfigureTimeout,
+// or Timeout if set and shorter.
+func (c *StratumClient) Configure(mask uint32) (err error) {
+	params := birpc.List{
+		[]string{"version-rolling"},
+		map[string]interface{}{
+			"version-rolling.mask":          fmt.Sprintf("%08x", mask),
+			"version-rolling.min-bit-count": 2,
+		},
+	}
+	timeout := ConfigureTimeout
+	if c.Timeout > 0 && c.Timeout < timeout {
+		timeout = c.Timeout
+	}
+	reply := make(map[string]interface{})
+	call := c.endpoint.Go("mining.configure", params, &reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(timeout):
+		log.Printf("mining.configure timeout, version rolling disabled")
+		return nil
+	}
+	if err != nil {
+		if _, ok := err.(*birpc.Error); ok {
+			log.Printf("mining.configure not supported: %s", err)
+			return nil
+		}
+		return err
+	}
+
+	context := c.Context()
+	if enabled, _ := reply["version-rolling"].(bool); !enabled {
+		context.setVersionMask(0)
+		return nil
+	}
+	hexMask, _ := reply["version-rolling.mask"].(string)
+	negotiated, err := HexToUint32(hexMask)
+	if err != nil {
+		return errors.New("Invalid version-rolling.mask")
+	}
+	context.setVersionMask(negotiated)
+	log.Printf("Version rolling enabled, mask %08x", negotiated)
+	return nil
+}
+
+// Authorize returns ErrAuthRejected if pool replied false or unauthorized
+// worker, AuthError for other errors and connection failure.
 func (c *StratumClient) Authorize(username, password string) error {
 	var authed bool
 	params := birpc.List{username, password}
-	err := c.endpoint.Call("mining.authorize", params, &authed)
+	err := c.call("mining.authorize", params, &authed)
+	if rpcErr, ok := err.(*birpc.Error); ok && rpcErr.Code == ErrorUnauthorizedWorker {
+		log.Printf("mining.authorize %s rejected: %s", username, err)
+		return ErrAuthRejected
+	}
 	if err != nil {
-		return errors.New("Auth failed.")
+		return &AuthError{err}
 	}
 
 	context := c.Context()
 	context.Username = username
 	context.Password = password
 	context.Authorized = authed
+	if !authed {
+		return ErrAuthRejected
+	}
 	return nil
 }
 
-func (c *StratumClient) Submit(username, jobId, extranonce2, ntime, nonce string) error {
+func (c *StratumClient) SuggestDifficulty(diff float64) error {
+	var ok bool
+	return c.call("mining.suggest_difficulty", birpc.List{diff}, &ok)
+}
+
+// Submit share, versionBits is optional, only when version rolling is
+// negotiated.
+func (c *StratumClient) Submit(username, jobId, extranonce2, ntime, nonce string, versionBits ...string) error {
 	var accepted bool
 	params := birpc.List{username, jobId, extranonce2, ntime, nonce}
-	return c.endpoint.Call("mining.submit", params, &accepted)
+	if len(versionBits) > 0 && versionBits[0] != "" {
+		params = append(params, versionBits[0])
+	}
+	if err := c.callTimeout("mining.submit", params, &accepted, SubmitTimeout); err != nil {
+		return err
+	}
+	if !accepted {
+		return ErrShareRejected
+	}
+	return nil
 }
@@ -0,0 +1,264 @@
+package stratum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Duration in config file is a string like "10s" or "5m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("Duration must be a string like \"10s\": %s", data)
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type VardiffConfig struct {
+	TargetTime   Duration
+	RetargetTime Duration
+	Variance     float64
+}
+
+func (vc *VardiffConfig) options() VardiffOptions {
+	return VardiffOptions{
+		TargetTime:   time.Duration(vc.TargetTime),
+		RetargetTime: time.Duration(vc.RetargetTime),
+		Variance:     vc.Variance,
+	}
+}
+
+type ListenerConfig struct {
+	Address       string
+	Algorithm     string
+	Difficulty    float64
+	MinDifficulty float64
+	MaxDifficulty float64
+	Vardiff       *VardiffConfig // nil for server vardiff
+	Orders        []uint64
+}
+
+type TimeoutConfig struct {
+	Subscribe  Duration
+	Pool       Duration
+	Configure  Duration
+	GetVersion Duration
+	Drain      Duration
+}
+
+type StorageConfig struct {
+	Dir string
+}
+
+// Config file in JSON. Orders, bans, vardiff, fees, VIP cap and subscribe
+// timeout are reloaded on SIGHUP, other settings take effect on restart.
+type Config struct {
+	Listeners      []ListenerConfig
+	Orders         []*Order
+	MinDifficulty  float64
+	MaxDifficulty  float64
+	Vardiff        *VardiffConfig
+	NtimeMaxAhead  *Duration // nil for default, explicit 0 allowed
+	NtimeMaxBehind *Duration
+	Bans           []string
+	Timeouts       TimeoutConfig
+	Storage        StorageConfig
+	BlockNotify    string
+	DrainRedirect  string
+	Http           string // address of metrics and APIs
+	AdminToken     string // bearer token of APIs changing state
+	MinPayout      uint64 // satoshi
+	Fees           *FeeSchedule
+	VipCapRatio    float64
+	AutoBidPeriod  Duration
+}
+
+func LoadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := &Config{}
+	if err := json.NewDecoder(file).Decode(config); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %s", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %s", path, err)
+	}
+	return config, nil
+}
+
+func (c *Config) Validate() error {
+	if c.MinDifficulty < 0 || c.MaxDifficulty < 0 ||
+		(c.MaxDifficulty > 0 && c.MinDifficulty > c.MaxDifficulty) {
+		return errors.New("Invalid difficulty bounds.")
+	}
+	if c.Vardiff != nil && (c.Vardiff.Variance < 0 || c.Vardiff.Variance > 100) {
+		return errors.New("Vardiff variance must be in 0-100 percent.")
+	}
+	if (c.NtimeMaxAhead != nil && *c.NtimeMaxAhead < 0) ||
+		(c.NtimeMaxBehind != nil && *c.NtimeMaxBehind < 0) {
+		return errors.New("Invalid ntime bounds.")
+	}
+
+	addresses := make(map[string]bool)
+	for _, lc := range c.Listeners {
+		lo := lc.options()
+		if err := lo.validate(); err != nil {
+			return err
+		}
+		if addresses[lo.Address] {
+			return fmt.Errorf("Duplicate listener %s.", lo.Address)
+		}
+		addresses[lo.Address] = true
+	}
+
+	ids := make(map[uint64]bool)
+	for _, order := range c.Orders {
+		if order.Id == 0 || ids[order.Id] {
+			return fmt.Errorf("Order id must be unique and non zero: %d", order.Id)
+		}
+		ids[order.Id] = true
+		if order.Hostname == "" || order.Port == "" || order.Username == "" {
+			return fmt.Errorf("Order #%d requires hostname, port and username.", order.Id)
+		}
+		if order.Algorithm != "" {
+			if _, err := FindAlgorithm(order.Algorithm); err != nil {
+				return fmt.Errorf("Order #%d: %s", order.Id, err)
+			}
+		}
+		if order.MaxPrice > 0 && order.MaxPrice < order.Price {
+			return fmt.Errorf("Order #%d max price under price.", order.Id)
+		}
+		if np := order.NtimePolicy; np != nil && (np.MaxAhead < 0 || np.MaxBehind < 0) {
+			return fmt.Errorf("Order #%d invalid ntime bounds.", order.Id)
+		}
+	}
+
+	if c.Fees != nil {
+		if err := c.Fees.validate(); err != nil {
+			return err
+		}
+	}
+	if c.VipCapRatio < 0 || c.VipCapRatio > 1 {
+		return errors.New("VIP cap ratio must be in 0-1.")
+	}
+
+	if c.DrainRedirect != "" {
+		if _, _, err := net.SplitHostPort(c.DrainRedirect); err != nil {
+			return fmt.Errorf("Invalid drain redirect: %s", err)
+		}
+	}
+
+	_, err := NewBanList(c.Bans)
+	return err
+}
+
+func (lc *ListenerConfig) options() ListenerOptions {
+	lo := ListenerOptions{
+		Address:       lc.Address,
+		Algorithm:     lc.Algorithm,
+		Difficulty:    lc.Difficulty,
+		MinDifficulty: lc.MinDifficulty,
+		MaxDifficulty: lc.MaxDifficulty,
+		Orders:        lc.Orders,
+	}
+	if lo.Algorithm == "" {
+		lo.Algorithm = SHA256.Name
+	}
+	if lc.Vardiff != nil {
+		lo.Vardiff = lc.Vardiff.options()
+	}
+	return lo
+}
+
+// Apply overrides options by settings present in config.
+func (c *Config) Apply(o *Options) {
+	if c.MinDifficulty > 0 {
+		o.MinDifficulty = c.MinDifficulty
+	}
+	if c.MaxDifficulty > 0 {
+		o.MaxDifficulty = c.MaxDifficulty
+	}
+	if c.Vardiff != nil {
+		o.Vardiff = c.Vardiff.options()
+	}
+	if c.NtimeMaxAhead != nil || c.NtimeMaxBehind != nil {
+		policy := *o.ntimePolicy()
+		if c.NtimeMaxAhead != nil {
+			policy.MaxAhead = *c.NtimeMaxAhead
+		}
+		if c.NtimeMaxBehind != nil {
+			policy.MaxBehind = *c.NtimeMaxBehind
+		}
+		o.Ntime = &policy
+	}
+	if c.Timeouts.Subscribe > 0 {
+		o.SubscribeTimeout = time.Duration(c.Timeouts.Subscribe)
+	}
+	if c.Timeouts.Pool > 0 {
+		o.PoolTimeout = time.Duration(c.Timeouts.Pool)
+	}
+	if c.Timeouts.Configure > 0 {
+		o.ConfigureTimeout = time.Duration(c.Timeouts.Configure)
+	}
+	if c.Timeouts.GetVersion > 0 {
+		o.GetVersionTimeout = time.Duration(c.Timeouts.GetVersion)
+	}
+	if c.Timeouts.Drain > 0 {
+		o.DrainTimeout = time.Duration(c.Timeouts.Drain)
+	}
+	if c.DrainRedirect != "" {
+		o.DrainRedirect = c.DrainRedirect
+	}
+	if c.Http != "" {
+		o.HttpAddress = c.Http
+	}
+	if c.AdminToken != "" {
+		o.AdminToken = c.AdminToken
+	}
+	if c.Storage.Dir != "" {
+		o.DataDir = c.Storage.Dir
+	}
+	if c.BlockNotify != "" {
+		o.BlockNotify = c.BlockNotify
+	}
+	if c.MinPayout > 0 {
+		o.MinPayout = c.MinPayout
+	}
+	if c.Fees != nil {
+		fees := *c.Fees
+		o.Fees = &fees
+	}
+	if c.VipCapRatio > 0 {
+		o.VipCapRatio = c.VipCapRatio
+	}
+	if c.AutoBidPeriod > 0 {
+		o.AutoBidPeriod = time.Duration(c.AutoBidPeriod)
+	}
+	if len(c.Listeners) > 0 {
+		o.Listeners = make([]ListenerOptions, len(c.Listeners))
+		for i := range c.Listeners {
+			o.Listeners[i] = c.Listeners[i].options()
+		}
+	}
+	o.Orders = c.Orders
+	o.Bans = c.Bans
+}
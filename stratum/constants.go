@@ -12,11 +12,25 @@ const (
 	ErrorLowDifficultyShare = 23
 	ErrorUnauthorizedWorker = 24
 	ErrorUnsubscribedWorker = 25
+	ErrorNtimeOutOfRange    = 26
 
 	ExtraNonce2Size = 2
 	ExtraNonce3Size = 2 // two bytes, up to 65535 clients.
 
 	DefaultDifficulty = 1 // now for testing only
+
+	// Default bounds of difficulty suggested by miners.
+	DefaultMinDifficulty = 0.0001
+	DefaultMaxDifficulty = 1 << 32
+
+	// BIP310 version rolling mask, bits miners may roll on block version.
+	DefaultVersionMask = 0x1fffe000
+
+	// Jobs kept by pool for share submission, older jobs are dropped
+	// together with their shares.
+	MaxPoolJobs = 16
+
+	DefaultListenAddress = ":3335"
 )
 
 var errorText = map[int]string{
@@ -26,6 +40,82 @@ var errorText = map[int]string{
 	ErrorLowDifficultyShare: "Low difficulty share",
 	ErrorUnauthorizedWorker: "Unauthorized worker",
 	ErrorUnsubscribedWorker: "Not subscribed",
+	ErrorNtimeOutOfRange:    "Ntime out of range",
 }
 
 var DefaultPoolTimeout = time.Duration(10) * time.Minute
+
+var ConfigureTimeout = time.Duration(5) * time.Second
+
+// Timeout of pre-checking upstream pool of an order, up to first job.
+var DefaultPoolCheckTimeout = time.Duration(30) * time.Second
+
+// Max timeout of pool check requested over API.
+const MaxPoolCheckTimeout = time.Duration(2) * time.Minute
+
+// Timeout waiting upstream reply of mining.submit, share counted as lost.
+var SubmitTimeout = time.Duration(30) * time.Second
+
+// Timeout waiting miner reply of client.get_version.
+var GetVersionTimeout = time.Duration(10) * time.Second
+
+// Version reported to upstream pools on client.get_version.
+const Version = "ninepool/0.1"
+
+// Default ntime bounds relative to job ntime.
+var (
+	DefaultNtimeMaxAhead  = time.Duration(7200) * time.Second
+	DefaultNtimeMaxBehind = time.Duration(0)
+)
+
+// Hard limit of ntime against wall clock, regardless of job.
+var MaxNtimeDrift = time.Duration(7200) * time.Second
+
+// Default vardiff, retargets for a share every 15 seconds per worker.
+var (
+	DefaultVardiffTargetTime   = time.Duration(15) * time.Second
+	DefaultVardiffRetargetTime = time.Duration(90) * time.Second
+	DefaultVardiffVariance     = 30.0
+)
+
+// Default timeout of drain, when miners redirected and submits waited.
+var DefaultDrainTimeout = time.Duration(30) * time.Second
+
+// Interval polling miners disconnected on drain.
+var DrainPollInterval = time.Duration(100) * time.Millisecond
+
+// Marketplace fee deducted from order spend before crediting sellers,
+// orders opting for VIP pay the VIP rate.
+var (
+	DefaultFeeRate    = 0.002
+	DefaultVipFeeRate = 0.004
+)
+
+// Max ratio of hashrate of an algorithm delivered to VIP orders, VIP orders
+// get no more workers over the cap.
+var DefaultVipCapRatio = 0.3
+
+// Auto bid raises order price after under target hashrate for the period,
+// checked every interval.
+var (
+	DefaultAutoBidPeriod = time.Duration(10) * time.Minute
+	AutoBidInterval      = time.Duration(30) * time.Second
+)
+
+// Reservations got active are checked for hashrate missing every interval.
+var ReservationInterval = time.Duration(10) * time.Second
+
+// Orders are banned when upstream rejects over the ratio of last shares
+// in window, and at least MaxUpstreamRejects of them. Stale rejects are
+// routine and never counted.
+var (
+	UpstreamRejectWindow   = 100
+	MaxUpstreamRejectRatio = 0.5
+	MaxUpstreamRejects     = 20
+)
+
+// Min seller balance in satoshi paid out in a batch.
+var DefaultMinPayout uint64 = 100000
+
+// Interval flushing stores, bounds data lost on a crash.
+var StoreFlushInterval = time.Duration(1) * time.Minute
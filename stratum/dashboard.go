@@ -0,0 +1,129 @@
+package stratum
+
+import (
+	"io"
+	"net/http"
+)
+
+// DashboardHandler serves a minimal page showing stats and live events.
+func (s *StratumServer) DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, dashboardHtml)
+}
+
+const dashboardHtml = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ninepool</title>
+<style>
+body { font-family: monospace; margin: 1em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: right; }
+#events { height: 20em; overflow-y: scroll; border: 1px solid #ccc; }
+#events p { margin: 0; }
+.rejected, .stale { color: #c00; }
+.block { color: #080; font-weight: bold; }
+</style>
+</head>
+<body>
+<h2>Pools</h2>
+<table id="pools"></table>
+<h2>Workers</h2>
+<table id="workers"></table>
+<h2>Events <span id="status"></span></h2>
+<div id="events"></div>
+<script>
+function hashrate(h) {
+	var units = ["H", "KH", "MH", "GH", "TH", "PH"];
+	var i = 0;
+	while (h >= 1000 && i < units.length - 1) { h /= 1000; i++; }
+	return h.toFixed(2) + " " + units[i] + "/s";
+}
+
+// cells are set by textContent, names and addresses come from miners.
+function tableRow(tag, values) {
+	var tr = document.createElement("tr");
+	values.forEach(function (v) {
+		var cell = document.createElement(tag);
+		cell.textContent = v;
+		tr.appendChild(cell);
+	});
+	return tr;
+}
+
+function table(id, columns, rows) {
+	var t = document.getElementById(id);
+	while (t.firstChild) {
+		t.removeChild(t.firstChild);
+	}
+	t.appendChild(tableRow("th", columns.map(function (c) { return c[0]; })));
+	rows.forEach(function (row) {
+		t.appendChild(tableRow("td", columns.map(function (c) { return c[1](row); })));
+	});
+}
+
+function refresh() {
+	fetch("/api/pools").then(function (r) { return r.json(); }).then(function (pools) {
+		table("pools", [
+			["order", function (p) { return p.Id; }],
+			["address", function (p) { return p.Address; }],
+			["state", function (p) { return p.State; }],
+			["workers", function (p) { return p.Workers; }],
+			["hashrate", function (p) { return hashrate(p.Hashrate["5m"]); }],
+			["job", function (p) { return p.CurrentJob; }]
+		], pools || []);
+	});
+	fetch("/api/workers").then(function (r) { return r.json(); }).then(function (workers) {
+		table("workers", [
+			["name", function (w) { return w.Name; }],
+			["addr", function (w) { return w.RemoteAddr; }],
+			["diff", function (w) { return w.Difficulty; }],
+			["5m", function (w) { return hashrate(w.Hashrate["5m"]); }],
+			["1h", function (w) { return hashrate(w.Hashrate["1h"]); }],
+			["accepted", function (w) { return w.Accepted; }],
+			["rejected", function (w) { return w.Rejected; }],
+			["order", function (w) { return w.Pool; }]
+		], workers || []);
+	});
+}
+
+function log(event) {
+	var div = document.getElementById("events");
+	var line = document.createElement("p");
+	var data = event.data || {};
+	line.className = data.result || event.type;
+	line.textContent = event.time + " " + event.type + " " + JSON.stringify(data);
+	div.insertBefore(line, div.firstChild);
+	while (div.childNodes.length > 500) {
+		div.removeChild(div.lastChild);
+	}
+}
+
+function connect() {
+	var scheme = window.location.protocol == "https:" ? "wss" : "ws";
+	var ws = new WebSocket(scheme + "://" + window.location.host + "/events");
+	ws.onopen = function () { document.getElementById("status").textContent = "(live)"; };
+	ws.onclose = function () {
+		document.getElementById("status").textContent = "(reconnecting)";
+		setTimeout(connect, 3000);
+	};
+	ws.onmessage = function (e) {
+		var rpc = JSON.parse(e.data);
+		if (rpc.method == "Dashboard.Event") {
+			log(rpc.params);
+		}
+	};
+}
+
+refresh();
+setInterval(refresh, 10000);
+connect();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,124 @@
+package stratum
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/yinhm/ninepool/birpc"
+	"github.com/yinhm/ninepool/birpc/wetsock"
+	"log"
+	"time"
+)
+
+// Event types streamed to dashboard.
+const (
+	EventJob              = "job"
+	EventShare            = "share"
+	EventWorkerConnect    = "worker_connect"
+	EventWorkerDisconnect = "worker_disconnect"
+	EventPoolState        = "pool_state"
+	EventBlock            = "block"
+	EventOrderPrice       = "order_price"
+)
+
+// Buffered events per dashboard connection, slow connections are kicked.
+const EventBufferSize = 100
+
+type Event struct {
+	Time time.Time   `json:"time"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type JobEvent struct {
+	Order     uint64 `json:"order"`
+	JobId     string `json:"job_id"`
+	CleanJobs bool   `json:"clean_jobs"`
+	Workers   int    `json:"workers"`
+}
+
+type ShareEvent struct {
+	Order      uint64  `json:"order"`
+	Worker     string  `json:"worker"`
+	Difficulty float64 `json:"difficulty"`
+	Result     string  `json:"result"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+type WorkerEvent struct {
+	RemoteAddr string `json:"remote_addr"`
+	Name       string `json:"name,omitempty"`
+}
+
+type PoolStateEvent struct {
+	Order uint64 `json:"order"`
+	State string `json:"state"`
+	From  string `json:"from,omitempty"`
+}
+
+type OrderPriceEvent struct {
+	Order    uint64 `json:"order"`
+	OldPrice uint64 `json:"old_price"`
+	Price    uint64 `json:"price"`
+}
+
+// publishEvent sends event to dashboards of default server.
+func publishEvent(eventType string, data interface{}) {
+	if DefaultServer == nil {
+		return
+	}
+	DefaultServer.publish(&Event{
+		Time: time.Now(),
+		Type: eventType,
+		Data: data,
+	})
+}
+
+// Dashboard service, events are pushed to browser by Dashboard.Event
+// notifications.
+type Dashboard struct {
+	server *StratumServer
+}
+
+type nothing struct{}
+
+// Pools replies pool stats, for dashboards rendering without polling API.
+func (d *Dashboard) Pools(args *nothing, reply *[]*PoolStats) error {
+	pools := d.server.Pools()
+	stats := make([]*PoolStats, len(pools))
+	for i, pool := range pools {
+		stats[i] = pool.Stats()
+	}
+	*reply = stats
+	return nil
+}
+
+// serveEvents streams events of broadcast topic to a websocket.
+func (s *StratumServer) serveEvents(ws *websocket.Conn) {
+	endpoint := wetsock.NewEndpoint(s.dashboard, ws)
+	events := make(chan interface{}, EventBufferSize)
+	s.broadcast.Register(events)
+	go func() {
+		defer s.broadcast.Unregister(events)
+		for event := range events {
+			msg := birpc.Message{
+				Func: "Dashboard.Event",
+				Args: event,
+			}
+			if err := endpoint.Notify(&msg); err != nil {
+				return
+			}
+		}
+		// broadcast topic kicked us out for being too slow
+		log.Printf("Kicking slow dashboard: %v", ws.Request().RemoteAddr)
+		ws.Close()
+	}()
+
+	err := endpoint.Serve()
+	if err != nil {
+		log.Printf("Dashboard %v disconnected: %v", ws.Request().RemoteAddr, err)
+	}
+}
+
+// EventsHandler serves event feed over websocket.
+func (s *StratumServer) EventsHandler() websocket.Handler {
+	return websocket.Handler(s.serveEvents)
+}
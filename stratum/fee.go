@@ -0,0 +1,31 @@
+package stratum
+
+import (
+	"errors"
+)
+
+// FeeSchedule is marketplace fee rates charged on order spend, VIP orders
+// pay a higher rate for priority on workers.
+type FeeSchedule struct {
+	Base float64
+	Vip  float64
+}
+
+func DefaultFeeSchedule() FeeSchedule {
+	return FeeSchedule{Base: DefaultFeeRate, Vip: DefaultVipFeeRate}
+}
+
+func (f FeeSchedule) validate() error {
+	if f.Base < 0 || f.Base >= 1 || f.Vip < 0 || f.Vip >= 1 {
+		return errors.New("Fee rates must be in 0-1.")
+	}
+	return nil
+}
+
+// Rate returns fee rate of order.
+func (f FeeSchedule) Rate(order *Order) float64 {
+	if order != nil && order.Vip {
+		return f.Vip
+	}
+	return f.Base
+}
@@ -0,0 +1,137 @@
+package stratum
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Buckets of a fixed window, shares in a bucket expire together.
+const HashrateBuckets = 60
+
+// Default time constant of hashrate moving average.
+var DefaultHashrateTau = time.Duration(10) * time.Minute
+
+// Hashrate in hashes per second.
+type Hashrate struct {
+	EMA float64 `json:"ema"`
+	M5  float64 `json:"5m"`
+	H1  float64 `json:"1h"`
+}
+
+// fixedWindow sums share difficulty of the last period in buckets, memory
+// is bounded regardless of share rate.
+type fixedWindow struct {
+	period  time.Duration
+	width   int64 // bucket width in nanoseconds
+	sums    [HashrateBuckets]float64
+	indexes [HashrateBuckets]int64 // bucket index since epoch
+}
+
+func newFixedWindow(period time.Duration) *fixedWindow {
+	return &fixedWindow{
+		period: period,
+		width:  int64(period) / HashrateBuckets,
+	}
+}
+
+func (fw *fixedWindow) add(difficulty float64, now time.Time) {
+	index := now.UnixNano() / fw.width
+	slot := index % HashrateBuckets
+	if fw.indexes[slot] != index {
+		fw.indexes[slot] = index
+		fw.sums[slot] = 0
+	}
+	fw.sums[slot] += difficulty
+}
+
+func (fw *fixedWindow) sum(now time.Time) float64 {
+	index := now.UnixNano() / fw.width
+	var sum float64
+	for slot, i := range fw.indexes {
+		if i > index-HashrateBuckets && i <= index {
+			sum += fw.sums[slot]
+		}
+	}
+	return sum
+}
+
+// HashrateEstimator estimates hashrate from difficulty of accepted shares,
+// by an exponential moving average and by fixed windows of 5 minutes and 1
+// hour. Estimates of an estimator younger than the window are scaled up to
+// the elapsed time. Safe for concurrent use.
+type HashrateEstimator struct {
+	lock           sync.Mutex
+	hashesPerShare float64
+	tau            time.Duration
+	ema            float64 // hashes per second at last share
+	last           time.Time
+	created        time.Time
+	short          *fixedWindow
+	long           *fixedWindow
+}
+
+func NewHashrateEstimator(algorithm *Algorithm, tau time.Duration, now time.Time) *HashrateEstimator {
+	return &HashrateEstimator{
+		hashesPerShare: algorithm.HashesPerShare(),
+		tau:            tau,
+		last:           now,
+		created:        now,
+		short:          newFixedWindow(ShortHashrateWindow),
+		long:           newFixedWindow(LongHashrateWindow),
+	}
+}
+
+// Add records an accepted share of difficulty.
+func (h *HashrateEstimator) Add(difficulty float64, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.ema = h.decay(now) + difficulty*h.hashesPerShare/h.tau.Seconds()
+	h.last = now
+	h.short.add(difficulty, now)
+	h.long.add(difficulty, now)
+}
+
+// decay returns ema decayed to now.
+func (h *HashrateEstimator) decay(now time.Time) float64 {
+	dt := now.Sub(h.last)
+	if dt <= 0 {
+		return h.ema
+	}
+	return h.ema * math.Exp(-dt.Seconds()/h.tau.Seconds())
+}
+
+func (h *HashrateEstimator) Hashrate(now time.Time) Hashrate {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	age := now.Sub(h.created).Seconds()
+	ema := h.decay(now)
+	// moving average starts from zero, unbias it while young
+	if age > 0 {
+		ema /= 1 - math.Exp(-age/h.tau.Seconds())
+	}
+	return Hashrate{
+		EMA: ema,
+		M5:  h.windowRate(h.short, now, age),
+		H1:  h.windowRate(h.long, now, age),
+	}
+}
+
+func (h *HashrateEstimator) windowRate(fw *fixedWindow, now time.Time, age float64) float64 {
+	seconds := fw.period.Seconds()
+	if age < seconds {
+		seconds = age
+	}
+	if seconds <= 0 {
+		return 0
+	}
+	return fw.sum(now) * h.hashesPerShare / seconds
+}
+
+// LastShare returns time of last share, creation time if no share yet.
+func (h *HashrateEstimator) LastShare() time.Time {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.last
+}
@@ -0,0 +1,394 @@
+package stratum
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const LedgerName = "ledger.json"
+
+// Account of a seller, keyed by payout address miners authorize with.
+type Account struct {
+	Address string
+	Shares  uint64  // accepted shares credited
+	Earned  float64 // satoshi credited in total
+	Paid    uint64  // satoshi paid out
+	Balance float64 // satoshi earned not paid yet
+	Updated time.Time
+}
+
+// OrderBill is spend of an order split to marketplace fee and sellers.
+type OrderBill struct {
+	Order    uint64
+	FeeRate  float64 // rate of latest charge
+	Spent    float64 // satoshi charged to order
+	Fee      float64 // satoshi kept by marketplace
+	Credited float64 // satoshi credited to sellers
+}
+
+type PayoutItem struct {
+	Address string
+	Amount  uint64 // satoshi
+}
+
+// Payout is a batch of balances over threshold, paid out together.
+type Payout struct {
+	Id      uint64
+	Created time.Time
+	Total   uint64
+	Items   []PayoutItem
+}
+
+// WriteCSV exports payout as address,amount lines.
+func (p *Payout) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"address", "amount"})
+	for _, item := range p.Items {
+		out.Write([]string{item.Address, strconv.FormatUint(item.Amount, 10)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// Ledger credits sellers for hashes delivered to orders, at order price
+// minus marketplace fee, fee of every order is billed. Balances reaching
+// min payout are paid out in batches. Ledger is kept as json file, in
+// memory only if path is empty.
+type Ledger struct {
+	lock      sync.Mutex
+	path      string
+	minPayout uint64
+	fees      FeeSchedule
+	accounts  map[string]*Account
+	orders    map[uint64]*OrderBill
+	payouts   []*Payout
+	dirty     bool
+}
+
+// ledgerFile is the json stored.
+type ledgerFile struct {
+	Accounts []*Account
+	Orders   []*OrderBill
+	Payouts  []*Payout
+}
+
+// NewLedger loads ledger from path if exists.
+func NewLedger(path string, minPayout uint64, fees FeeSchedule) (*Ledger, error) {
+	l := &Ledger{
+		path:      path,
+		minPayout: minPayout,
+		fees:      fees,
+		accounts:  make(map[string]*Account),
+		orders:    make(map[uint64]*OrderBill),
+	}
+	if path == "" {
+		return l, nil
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var stored ledgerFile
+	if err := json.NewDecoder(file).Decode(&stored); err != nil {
+		return nil, err
+	}
+	for _, account := range stored.Accounts {
+		l.accounts[account.Address] = account
+	}
+	for _, bill := range stored.Orders {
+		l.orders[bill.Order] = bill
+	}
+	l.payouts = stored.Payouts
+	return l, nil
+}
+
+// Credit credits seller for satoshi spent by order, marketplace fee of
+// order deducted and billed.
+func (l *Ledger) Credit(order *Order, address string, spent float64) {
+	if l == nil || address == "" {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	rate := l.fees.Rate(order)
+	fee := spent * rate
+	earned := spent - fee
+
+	// shares of no order are credited without a bill
+	if order != nil {
+		bill, ok := l.orders[order.Id]
+		if !ok {
+			bill = &OrderBill{Order: order.Id}
+			l.orders[order.Id] = bill
+		}
+		bill.FeeRate = rate
+		bill.Spent += spent
+		bill.Fee += fee
+		bill.Credited += earned
+	}
+
+	account, ok := l.accounts[address]
+	if !ok {
+		account = &Account{Address: address}
+		l.accounts[address] = account
+	}
+	account.Shares += 1
+	account.Earned += earned
+	account.Balance += earned
+	account.Updated = time.Now()
+	l.dirty = true
+}
+
+// Fees returns fee schedule of ledger.
+func (l *Ledger) Fees() FeeSchedule {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.fees
+}
+
+// SetFees changes fee rates of spend credited afterwards.
+func (l *Ledger) SetFees(fees FeeSchedule) {
+	l.lock.Lock()
+	l.fees = fees
+	l.lock.Unlock()
+}
+
+// Bill returns copy of order bill, false if order never charged.
+func (l *Ledger) Bill(orderId uint64) (OrderBill, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	bill, ok := l.orders[orderId]
+	if !ok {
+		return OrderBill{}, false
+	}
+	return *bill, true
+}
+
+// Account returns copy of seller account, false if never credited.
+func (l *Ledger) Account(address string) (Account, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	account, ok := l.accounts[address]
+	if !ok {
+		return Account{}, false
+	}
+	return *account, true
+}
+
+// Accounts returns copy of all accounts sorted by address.
+func (l *Ledger) Accounts() []Account {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	accounts := make([]Account, 0, len(l.accounts))
+	for _, account := range l.accounts {
+		accounts = append(accounts, *account)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Address < accounts[j].Address })
+	return accounts
+}
+
+// Due returns whole satoshi balances reaching min payout, sorted by address.
+func (l *Ledger) Due() []PayoutItem {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.due()
+}
+
+func (l *Ledger) due() []PayoutItem {
+	items := []PayoutItem{}
+	for _, account := range l.accounts {
+		amount := uint64(math.Floor(account.Balance))
+		if amount > 0 && amount >= l.minPayout {
+			items = append(items, PayoutItem{account.Address, amount})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Address < items[j].Address })
+	return items
+}
+
+// CreatePayout pays out due balances in a new batch, nil if nothing due.
+// Ledger is saved at once, a batch must never be paid twice.
+func (l *Ledger) CreatePayout() (*Payout, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	items := l.due()
+	if len(items) == 0 {
+		return nil, nil
+	}
+	payout := &Payout{
+		Id:      uint64(len(l.payouts) + 1),
+		Created: time.Now(),
+		Items:   items,
+	}
+	for _, item := range items {
+		account := l.accounts[item.Address]
+		account.Paid += item.Amount
+		account.Balance -= float64(item.Amount)
+		payout.Total += item.Amount
+	}
+	l.payouts = append(l.payouts, payout)
+	l.dirty = true
+	return payout, l.save()
+}
+
+// Payouts returns batches paid, oldest first.
+func (l *Ledger) Payouts() []*Payout {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]*Payout(nil), l.payouts...)
+}
+
+func (l *Ledger) findPayout(id uint64) (*Payout, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if id == 0 || id > uint64(len(l.payouts)) {
+		return nil, false
+	}
+	return l.payouts[id-1], true
+}
+
+// Flush saves ledger if changed.
+func (l *Ledger) Flush() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.save()
+}
+
+// save writes ledger to a temp file renamed over, a crash never leaves a
+// partial ledger.
+func (l *Ledger) save() error {
+	if l.path == "" || !l.dirty {
+		return nil
+	}
+	stored := ledgerFile{Payouts: l.payouts}
+	for _, account := range l.accounts {
+		stored.Accounts = append(stored.Accounts, account)
+	}
+	sort.Slice(stored.Accounts, func(i, j int) bool {
+		return stored.Accounts[i].Address < stored.Accounts[j].Address
+	})
+	for _, bill := range l.orders {
+		stored.Orders = append(stored.Orders, bill)
+	}
+	sort.Slice(stored.Orders, func(i, j int) bool {
+		return stored.Orders[i].Order < stored.Orders[j].Order
+	})
+	buf, err := json.MarshalIndent(&stored, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// Ledger of server.
+func (s *StratumServer) Ledger() *Ledger {
+	return s.ledger
+}
+
+// flushLoop flushes stores periodically until server closing, data lost
+// on a crash is bounded by the interval.
+func (s *StratumServer) flushLoop() {
+	ticker := time.NewTicker(StoreFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.lock.Lock()
+		closing := s.closing
+		flushers := s.flushers
+		s.lock.Unlock()
+		if closing {
+			return
+		}
+		for _, flusher := range flushers {
+			if err := flusher.Flush(); err != nil {
+				log.Printf("Failed to flush store: %s", err)
+			}
+		}
+	}
+}
+
+// BalancesHandler serves seller accounts.
+func (s *StratumServer) BalancesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, s.ledger.Accounts())
+}
+
+// PayoutsHandler lists payout batches on GET, or exports a batch by id.
+// POST creates a batch of due balances. Batch is exported as json, or csv
+// if format=csv.
+func (s *StratumServer) PayoutsHandler(w http.ResponseWriter, r *http.Request) {
+	var payout *Payout
+	switch r.Method {
+	case "GET":
+		idStr := r.URL.Query().Get("id")
+		if idStr == "" {
+			writeJson(w, s.ledger.Payouts())
+			return
+		}
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id.", http.StatusBadRequest)
+			return
+		}
+		var ok bool
+		if payout, ok = s.ledger.findPayout(id); !ok {
+			http.Error(w, "Payout not found.", http.StatusNotFound)
+			return
+		}
+	case "POST":
+		var err error
+		payout, err = s.ledger.CreatePayout()
+		if err != nil {
+			log.Printf("Failed to save ledger: %s", err)
+			http.Error(w, "Ledger error.", http.StatusInternalServerError)
+			return
+		}
+		if payout == nil {
+			http.Error(w, "No balance due.", http.StatusNotFound)
+			return
+		}
+		log.Printf("[Ledger] payout #%d created, %d satoshi to %d sellers.",
+			payout.Id, payout.Total, len(payout.Items))
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition",
+			"attachment; filename=payout-"+strconv.FormatUint(payout.Id, 10)+".csv")
+		if err := payout.WriteCSV(w); err != nil {
+			log.Printf("Failed to write csv: %s", err)
+		}
+		return
+	}
+	writeJson(w, payout)
+}
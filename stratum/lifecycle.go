@@ -0,0 +1,182 @@
+package stratum
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PauseOrder stops binding workers to order, workers bound are released
+// to other orders.
+func (s *StratumServer) PauseOrder(id uint64) error {
+	order, pool, err := s.findOrder(id)
+	if err != nil {
+		return err
+	}
+	if err := order.setState(StatePause); err != nil {
+		return err
+	}
+	if pool != nil {
+		pool.releaseWorkers()
+	}
+	return nil
+}
+
+// ResumeOrder binds workers to paused order again, workers of orders at
+// lower price are asked to reconnect and bound to best order.
+func (s *StratumServer) ResumeOrder(id uint64) error {
+	order, pool, err := s.findOrder(id)
+	if err != nil {
+		return err
+	}
+	if order.state() != StatePause {
+		return fmt.Errorf("Order #%d not paused.", order.Id)
+	}
+	if pool == nil || pool.isClosed() {
+		return order.setState(StateDead)
+	}
+	if err := order.setState(StateConnected); err != nil {
+		return err
+	}
+	order.markWorkers(pool.workerCount())
+	s.reacquireWorkers(pool)
+	return nil
+}
+
+// reacquireWorkers asks workers of pools at lower price than order of pool
+// to reconnect, cheapest first, until hashrate missing to target of order
+// released. All of them if order has no target.
+func (s *StratumServer) reacquireWorkers(pool *Pool) {
+	order := pool.order
+	missing := math.Inf(1)
+	if order.TargetHashrate > 0 {
+		missing = order.TargetHashrate - order.Hashrate().EMA
+	}
+	if missing > 0 {
+		s.releaseWorkers(pool, missing, order.price(), time.Now())
+	}
+}
+
+// BanOrder bans order, its pool is stopped and workers released.
+func (s *StratumServer) BanOrder(id uint64, reason string) error {
+	order, _, err := s.findOrder(id)
+	if err != nil {
+		return err
+	}
+	return s.stopOrder(order, StateBanned, reason)
+}
+
+// banOrder bans order automatically on upstream failures.
+func (s *StratumServer) banOrder(order *Order, reason string) {
+	if err := s.stopOrder(order, StateBanned, reason); err != nil {
+		log.Printf("Failed to ban order #%d: %s", order.Id, err)
+	}
+}
+
+// UnbanOrder reconnects banned order.
+func (s *StratumServer) UnbanOrder(id uint64) error {
+	order, _, err := s.findOrder(id)
+	if err != nil {
+		return err
+	}
+	if err := order.setState(StateInit); err != nil {
+		return err
+	}
+	go s.activeOrder(order)
+	return nil
+}
+
+// CancelOrder closes order by buyer.
+func (s *StratumServer) CancelOrder(id uint64) error {
+	order, _, err := s.findOrder(id)
+	if err != nil {
+		return err
+	}
+	return s.stopOrder(order, StateClosedCannel, "cancelled")
+}
+
+// completeOrder closes order spent its amount.
+func (s *StratumServer) completeOrder(order *Order) {
+	// concurrent shares may complete order more than once
+	if order.state() == StateClosedComplete {
+		return
+	}
+	if err := s.stopOrder(order, StateClosedComplete, "amount spent"); err != nil {
+		log.Printf("Failed to complete order #%d: %s", order.Id, err)
+	}
+}
+
+// stopOrder moves order to banned or closed state, workers are released
+// and pool stopped.
+func (s *StratumServer) stopOrder(order *Order, state uint32, reason string) error {
+	if err := order.setState(state); err != nil {
+		return err
+	}
+	log.Printf("[Order] #%d %s: %s.", order.Id, StateName(state), reason)
+
+	s.lock.Lock()
+	pool, ok := s.pools[order.Id]
+	delete(s.pools, order.Id)
+	delete(s.perrchs, order.Id)
+	s.lock.Unlock()
+	if ok {
+		pool.releaseWorkers()
+		pool.Shutdown()
+	}
+	return nil
+}
+
+func (s *StratumServer) findOrder(id uint64) (*Order, *Pool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	order, ok := s.orders[id]
+	if !ok {
+		return nil, nil, ErrOrderNotFound
+	}
+	return order, s.pools[id], nil
+}
+
+// OrderStateHandler changes state of order by id on POST, action is one
+// of pause, resume, ban, unban and cancel.
+func (s *StratumServer) OrderStateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	id, err := strconv.ParseUint(params.Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id.", http.StatusBadRequest)
+		return
+	}
+
+	switch params.Get("action") {
+	case "pause":
+		err = s.PauseOrder(id)
+	case "resume":
+		err = s.ResumeOrder(id)
+	case "ban":
+		err = s.BanOrder(id, "banned by operator")
+	case "unban":
+		err = s.UnbanOrder(id)
+	case "cancel":
+		err = s.CancelOrder(id)
+	default:
+		http.Error(w, "Invalid action.", http.StatusBadRequest)
+		return
+	}
+	if err == ErrOrderNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	order, _, _ := s.findOrder(id)
+	writeJson(w, order.Stats())
+}
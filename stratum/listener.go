@@ -0,0 +1,150 @@
+package stratum
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ListenerOptions is the profile of a listen port, workers connected to it
+// hash by Algorithm and are bound only to eligible orders.
+type ListenerOptions struct {
+	Address       string
+	Algorithm     string
+	Difficulty    float64 // starting difficulty
+	MinDifficulty float64
+	MaxDifficulty float64
+	Vardiff       VardiffOptions
+	Orders        []uint64 // eligible orders, empty for all of algorithm
+
+	inheritVardiff bool // vardiff of server, follows it on reload
+}
+
+func DefaultListenerOptions() ListenerOptions {
+	return ListenerOptions{
+		Address:       DefaultListenAddress,
+		Algorithm:     SHA256.Name,
+		Difficulty:    DefaultDifficulty,
+		MinDifficulty: DefaultMinDifficulty,
+		MaxDifficulty: DefaultMaxDifficulty,
+	}
+}
+
+// ParseListener parses listener in the form of
+// "algorithm@address[/difficulty[/min[/max]]]", eg: "scrypt@:3336/65536".
+func ParseListener(value string) (options ListenerOptions, err error) {
+	options = ListenerOptions{Algorithm: SHA256.Name}
+	at := strings.Index(value, "@")
+	if at >= 0 {
+		options.Algorithm = value[:at]
+		value = value[at+1:]
+	}
+
+	parts := strings.Split(value, "/")
+	if len(parts) > 4 {
+		return options, fmt.Errorf("Invalid listener: %s", value)
+	}
+	options.Address = parts[0]
+	diffs := []*float64{&options.Difficulty, &options.MinDifficulty, &options.MaxDifficulty}
+	for i, part := range parts[1:] {
+		*diffs[i], err = strconv.ParseFloat(part, 64)
+		if err != nil {
+			return options, fmt.Errorf("Invalid listener difficulty: %s", part)
+		}
+	}
+	return options, options.validate()
+}
+
+func (lo *ListenerOptions) validate() error {
+	if lo.Address == "" {
+		return errors.New("Listener address required.")
+	}
+	if _, err := FindAlgorithm(lo.Algorithm); err != nil {
+		return err
+	}
+	if lo.MinDifficulty < 0 || lo.MaxDifficulty < 0 || lo.Difficulty < 0 {
+		return fmt.Errorf("Invalid difficulty on listener %s.", lo.Address)
+	}
+	if lo.MaxDifficulty > 0 && lo.MinDifficulty > lo.MaxDifficulty {
+		return fmt.Errorf("Min difficulty exceeds max on listener %s.", lo.Address)
+	}
+	return nil
+}
+
+// setDefaults fills unset difficulty profile from server options, vardiff
+// inherited is filled again on every call.
+func (lo *ListenerOptions) setDefaults(options *Options) {
+	if lo.MinDifficulty == 0 {
+		lo.MinDifficulty = options.MinDifficulty
+	}
+	if lo.MaxDifficulty == 0 {
+		lo.MaxDifficulty = options.MaxDifficulty
+	}
+	if lo.Difficulty == 0 {
+		lo.Difficulty = DefaultDifficulty
+	}
+	if lo.Vardiff == (VardiffOptions{}) || lo.inheritVardiff {
+		lo.Vardiff = options.Vardiff
+		lo.inheritVardiff = true
+	}
+}
+
+// eligible tests if workers on listener can be bound to order. Orders
+// without algorithm are accepted by any listener.
+func (lo *ListenerOptions) eligible(order *Order) bool {
+	if order.Algorithm != "" && order.Algorithm != lo.Algorithm {
+		return false
+	}
+	if len(lo.Orders) == 0 {
+		return true
+	}
+	for _, id := range lo.Orders {
+		if id == order.Id {
+			return true
+		}
+	}
+	return false
+}
+
+func (lo *ListenerOptions) String() string {
+	return fmt.Sprintf("%s@%s/%v/%v/%v", lo.Algorithm, lo.Address,
+		lo.Difficulty, lo.MinDifficulty, lo.MaxDifficulty)
+}
+
+// listenerFlags collects repeated -listen flags.
+type listenerFlags []ListenerOptions
+
+func (lf *listenerFlags) String() string {
+	names := make([]string, len(*lf))
+	for i, lo := range *lf {
+		names[i] = lo.String()
+	}
+	return strings.Join(names, ",")
+}
+
+func (lf *listenerFlags) Set(value string) error {
+	options, err := ParseListener(value)
+	if err != nil {
+		return err
+	}
+	*lf = append(*lf, options)
+	return nil
+}
+
+type Listener struct {
+	net.Listener
+	Options *ListenerOptions
+}
+
+func Listen(options ListenerOptions) (*Listener, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp4", options.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{Listener: ln, Options: &options}, nil
+}
@@ -0,0 +1,273 @@
+package stratum
+
+import (
+	"fmt"
+	"github.com/yinhm/ninepool/birpc"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reason label of share rejections in metrics.
+var errorReason = map[int]string{
+	ErrorUnknown:            "unknown",
+	ErrorJobNotFound:        "job_not_found",
+	ErrorDuplicateShare:     "duplicate_share",
+	ErrorLowDifficultyShare: "low_difficulty_share",
+	ErrorUnauthorizedWorker: "unauthorized_worker",
+	ErrorUnsubscribedWorker: "unsubscribed_worker",
+	ErrorNtimeOutOfRange:    "ntime_out_of_range",
+}
+
+// Buckets of latency histograms in seconds.
+var LatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Histogram of fixed buckets, in prometheus text format.
+type Histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, labels, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, trimComma(labels), h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, trimComma(labels), h.count)
+}
+
+func trimComma(labels string) string {
+	if len(labels) > 0 && labels[len(labels)-1] == ',' {
+		return labels[:len(labels)-1]
+	}
+	return labels
+}
+
+type shareLabel struct {
+	order  uint64
+	result string
+	reason string
+}
+
+// Metrics collects counters and histograms of server, gauges are read from
+// server state on scrape. Methods are safe on nil metrics.
+type Metrics struct {
+	lock      sync.Mutex
+	shares    map[shareLabel]uint64 // shares from workers
+	upstream  map[shareLabel]uint64 // shares submitted to upstream pools
+	submits   map[uint64]*Histogram // upstream submit latency
+	broadcast map[uint64]*Histogram // job fan-out time
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		shares:    make(map[shareLabel]uint64),
+		upstream:  make(map[shareLabel]uint64),
+		submits:   make(map[uint64]*Histogram),
+		broadcast: make(map[uint64]*Histogram),
+	}
+}
+
+// serverMetrics returns metrics of default server, nil if no server.
+func serverMetrics() *Metrics {
+	if DefaultServer == nil {
+		return nil
+	}
+	return DefaultServer.metrics
+}
+
+// shareResult returns result and reason of error returned from submit,
+// shares of jobs not found are stale.
+func shareResult(err error) (result, reason string) {
+	if err == nil {
+		return "accepted", ""
+	}
+	result, reason = "rejected", errorReason[ErrorUnknown]
+	if rpcErr, ok := err.(*birpc.Error); ok {
+		if r, ok := errorReason[rpcErr.Code]; ok {
+			reason = r
+		}
+		if rpcErr.Code == ErrorJobNotFound {
+			result = "stale"
+		}
+	}
+	return result, reason
+}
+
+// share counts share result of worker by error returned from submit.
+func (m *Metrics) share(orderId uint64, err error) {
+	if m == nil {
+		return
+	}
+	result, reason := shareResult(err)
+	label := shareLabel{order: orderId, result: result, reason: reason}
+	m.lock.Lock()
+	m.shares[label]++
+	m.lock.Unlock()
+}
+
+func (m *Metrics) upstreamShare(orderId uint64, accepted bool, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	label := shareLabel{order: orderId, result: "accepted"}
+	if !accepted {
+		label.result = "rejected"
+	}
+	m.lock.Lock()
+	m.upstream[label]++
+	h := m.histogram(m.submits, orderId)
+	m.lock.Unlock()
+	h.Observe(latency.Seconds())
+}
+
+func (m *Metrics) jobBroadcast(orderId uint64, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	h := m.histogram(m.broadcast, orderId)
+	m.lock.Unlock()
+	h.Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) histogram(histograms map[uint64]*Histogram, orderId uint64) *Histogram {
+	h, ok := histograms[orderId]
+	if !ok {
+		h = NewHistogram(LatencyBuckets)
+		histograms[orderId] = h
+	}
+	return h
+}
+
+func writeShares(w io.Writer, name string, shares map[shareLabel]uint64) {
+	labels := make([]shareLabel, 0, len(shares))
+	for label := range shares {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.order != b.order {
+			return a.order < b.order
+		}
+		if a.result != b.result {
+			return a.result < b.result
+		}
+		return a.reason < b.reason
+	})
+	for _, label := range labels {
+		if label.reason == "" {
+			fmt.Fprintf(w, "%s{order=\"%d\",result=\"%s\"} %d\n",
+				name, label.order, label.result, shares[label])
+		} else {
+			fmt.Fprintf(w, "%s{order=\"%d\",result=\"%s\",reason=\"%s\"} %d\n",
+				name, label.order, label.result, label.reason, shares[label])
+		}
+	}
+}
+
+func writeHistograms(w io.Writer, name string, histograms map[uint64]*Histogram) {
+	ids := make([]uint64, 0, len(histograms))
+	for id := range histograms {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		histograms[id].write(w, name, fmt.Sprintf("order=\"%d\",", id))
+	}
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintln(w, "# HELP ninepool_shares_total Shares submitted by workers.")
+	fmt.Fprintln(w, "# TYPE ninepool_shares_total counter")
+	writeShares(w, "ninepool_shares_total", m.shares)
+
+	fmt.Fprintln(w, "# HELP ninepool_upstream_shares_total Shares submitted to upstream pools.")
+	fmt.Fprintln(w, "# TYPE ninepool_upstream_shares_total counter")
+	writeShares(w, "ninepool_upstream_shares_total", m.upstream)
+
+	fmt.Fprintln(w, "# HELP ninepool_upstream_submit_seconds Latency of share submission to upstream pools.")
+	fmt.Fprintln(w, "# TYPE ninepool_upstream_submit_seconds histogram")
+	writeHistograms(w, "ninepool_upstream_submit_seconds", m.submits)
+
+	fmt.Fprintln(w, "# HELP ninepool_job_broadcast_seconds Time of sending a job to all workers of a pool.")
+	fmt.Fprintln(w, "# TYPE ninepool_job_broadcast_seconds histogram")
+	writeHistograms(w, "ninepool_job_broadcast_seconds", m.broadcast)
+}
+
+// MetricsHandler serves metrics in prometheus text format.
+func (s *StratumServer) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP ninepool_workers_connected Connected workers.")
+	fmt.Fprintln(w, "# TYPE ninepool_workers_connected gauge")
+	fmt.Fprintf(w, "ninepool_workers_connected %d\n", len(s.Workers()))
+
+	pools := s.Pools()
+	gauges := []struct {
+		name, help string
+		value      func(p *Pool) float64
+	}{
+		{"ninepool_pool_up", "Pool connected to upstream.", func(p *Pool) float64 {
+			if p.isAvailable() {
+				return 1
+			}
+			return 0
+		}},
+		{"ninepool_pool_workers", "Workers bound to pool.", func(p *Pool) float64 {
+			return float64(p.workerCount())
+		}},
+		{"ninepool_pool_hashrate", "Hashrate delivered to pool in hashes per second over 5 minutes.", func(p *Pool) float64 {
+			return p.hashrate().M5
+		}},
+		{"ninepool_nonce_utilization", "Ratio of extranonce space issued to workers.", func(p *Pool) float64 {
+			return p.nonceCounter.Utilization()
+		}},
+	}
+	for _, gauge := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n", gauge.name, gauge.help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", gauge.name)
+		for _, p := range pools {
+			fmt.Fprintf(w, "%s{order=\"%d\",pool=\"%s\"} %g\n", gauge.name, p.id, p.address, gauge.value(p))
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP ninepool_order_hashrate Hashrate delivered to order in hashes per second over 5 minutes.")
+	fmt.Fprintln(w, "# TYPE ninepool_order_hashrate gauge")
+	for _, p := range pools {
+		fmt.Fprintf(w, "ninepool_order_hashrate{order=\"%d\",algorithm=\"%s\"} %g\n",
+			p.order.Id, p.order.Algorithm, p.order.Hashrate().M5)
+	}
+
+	s.metrics.write(w)
+}
@@ -2,16 +2,164 @@ package stratum
 
 import (
 	"flag"
+	"os"
 	"time"
 )
 
 type Options struct {
 	SubscribeTimeout time.Duration
+	Ntime            *NtimePolicy // nil for default bounds
+	MinDifficulty    float64
+	MaxDifficulty    float64
+	BlockNotify      string
+	Listeners        []ListenerOptions
+	Vardiff          VardiffOptions
+
+	ConfigFile        string
+	PoolTimeout       time.Duration
+	ConfigureTimeout  time.Duration
+	GetVersionTimeout time.Duration
+	DataDir           string // storage of share log and ledger
+	Orders            []*Order
+	Bans              []string
+	DrainTimeout      time.Duration
+	DrainRedirect     string       // host:port miners redirected to on drain
+	HttpAddress       string       // metrics and APIs, disabled if empty
+	AdminToken        string       // required by APIs changing state, disabled if empty
+	MinPayout         uint64       // satoshi
+	Fees              *FeeSchedule // nil for default
+	VipCapRatio       float64      // 0 for default
+	AutoBidPeriod     time.Duration
 }
 
 func ParseCommandLine() (options Options, err error) {
+	options.Ntime = defaultNtimePolicy()
 	flag.DurationVar(&options.SubscribeTimeout, "subscribeTimeout",
 			time.Duration(10)*time.Second, "Subscribe timeout")
+	flag.DurationVar((*time.Duration)(&options.Ntime.MaxAhead), "ntimeMaxAhead",
+			DefaultNtimeMaxAhead, "Max ntime rolled ahead of job ntime")
+	flag.DurationVar((*time.Duration)(&options.Ntime.MaxBehind), "ntimeMaxBehind",
+			DefaultNtimeMaxBehind, "Max ntime behind job ntime")
+	flag.Float64Var(&options.MinDifficulty, "minDifficulty",
+			DefaultMinDifficulty, "Min difficulty miner can suggest")
+	flag.Float64Var(&options.MaxDifficulty, "maxDifficulty",
+			DefaultMaxDifficulty, "Max difficulty miner can suggest")
+	flag.StringVar(&options.BlockNotify, "blocknotify", "",
+			"Execute command when block candidate found (%s in cmd is replaced by block hash)")
+	flag.DurationVar(&options.Vardiff.TargetTime, "vardiffTarget",
+			DefaultVardiffTargetTime, "Vardiff share interval, 0 to disable")
+	flag.DurationVar(&options.Vardiff.RetargetTime, "vardiffRetarget",
+			DefaultVardiffRetargetTime, "Vardiff retarget interval")
+	flag.Float64Var(&options.Vardiff.Variance, "vardiffVariance",
+			DefaultVardiffVariance, "Vardiff share interval variance in percent")
+	flag.StringVar(&options.ConfigFile, "config", "",
+			"JSON config file, reloaded on SIGHUP")
+	flag.StringVar(&options.DataDir, "datadir", "",
+			"Storage directory")
+	flag.DurationVar(&options.DrainTimeout, "drainTimeout",
+			DefaultDrainTimeout, "Max time waiting miners and submits on shutdown")
+	flag.StringVar(&options.DrainRedirect, "drainRedirect", "",
+			"Redirect miners to host:port on shutdown, default reconnect to same host")
+	flag.Uint64Var(&options.MinPayout, "minPayout",
+			DefaultMinPayout, "Min seller balance in satoshi paid out")
+	options.Fees = &FeeSchedule{}
+	flag.Float64Var(&options.Fees.Base, "fee",
+			DefaultFeeRate, "Marketplace fee rate of order spend")
+	flag.Float64Var(&options.Fees.Vip, "vipFee",
+			DefaultVipFeeRate, "Marketplace fee rate of VIP orders")
+	flag.Float64Var(&options.VipCapRatio, "vipCap",
+			DefaultVipCapRatio, "Max ratio of hashrate of an algorithm delivered to VIP orders")
+	flag.DurationVar(&options.AutoBidPeriod, "autoBidPeriod",
+			DefaultAutoBidPeriod, "Time order under target hashrate before price raised")
+	flag.StringVar(&options.HttpAddress, "http", "",
+			"Serve /metrics and APIs on address, eg: 127.0.0.1:8335")
+	flag.StringVar(&options.AdminToken, "adminToken", "",
+			"Bearer token of APIs changing state, disabled if empty")
+	var listeners listenerFlags
+	flag.Var(&listeners, "listen",
+			"Listen on algorithm@address[/difficulty[/min[/max]]], repeatable (default sha256@:3335)")
 	flag.Parse()
+
+	options.Listeners = listeners
+	if options.ConfigFile != "" {
+		config, err := LoadConfig(options.ConfigFile)
+		if err != nil {
+			return options, err
+		}
+		config.Apply(&options)
+	}
+	if len(options.Listeners) == 0 {
+		options.Listeners = append(options.Listeners, DefaultListenerOptions())
+	}
+	options.setListenerDefaults()
+
+	if options.DataDir != "" {
+		if err := os.MkdirAll(options.DataDir, 0755); err != nil {
+			return options, err
+		}
+	}
 	return options, nil
 }
+
+// setTimeouts overrides package timeouts by options, called once on server
+// creation.
+func (o *Options) setTimeouts() {
+	if o.PoolTimeout > 0 {
+		DefaultPoolTimeout = o.PoolTimeout
+	}
+	if o.ConfigureTimeout > 0 {
+		ConfigureTimeout = o.ConfigureTimeout
+	}
+	if o.GetVersionTimeout > 0 {
+		GetVersionTimeout = o.GetVersionTimeout
+	}
+}
+
+// setListenerDefaults fills listener profiles unset from server options.
+func (o *Options) setListenerDefaults() {
+	for i := range o.Listeners {
+		o.Listeners[i].setDefaults(o)
+	}
+}
+
+// algorithms returns algorithms served by listeners.
+func (o *Options) algorithms() []string {
+	seen := make(map[string]bool)
+	algos := make([]string, 0, len(o.Listeners))
+	for _, lo := range o.Listeners {
+		if !seen[lo.Algorithm] {
+			seen[lo.Algorithm] = true
+			algos = append(algos, lo.Algorithm)
+		}
+	}
+	if len(algos) == 0 {
+		algos = append(algos, SHA256.Name)
+	}
+	return algos
+}
+
+// defaultListener is the profile of connections served by ServeConn, the
+// first listener configured.
+func (o *Options) defaultListener() *ListenerOptions {
+	if len(o.Listeners) > 0 {
+		return &o.Listeners[0]
+	}
+	lo := DefaultListenerOptions()
+	lo.setDefaults(o)
+	return &lo
+}
+
+// ntimePolicy returns server wide ntime bounds, defaults if not set.
+func (o *Options) ntimePolicy() *NtimePolicy {
+	if o.Ntime != nil {
+		return o.Ntime
+	}
+	return defaultNtimePolicy()
+}
+
+func defaultNtimePolicy() *NtimePolicy {
+	return &NtimePolicy{
+		MaxAhead:  Duration(DefaultNtimeMaxAhead),
+		MaxBehind: Duration(DefaultNtimeMaxBehind),
+	}
+}
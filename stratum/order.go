@@ -1,8 +1,11 @@
 package stratum
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"math"
+	"sync"
 	"time"
 )
 
@@ -20,6 +23,8 @@ const (
 	STAOSHI = 1 << (10 * iota)
 )
 
+var ErrOrderNotFound = errors.New("Order not found.")
+
 var (
 	UNIT_SATOSHI = uint64(math.Pow(float64(10), float64(8)))
 )
@@ -30,7 +35,14 @@ type Order struct {
 	Algorithm string
 	// in satoshi, 10**8 staoshi = 1 btc
 	Amount uint64
-	Price  uint64
+	Price  uint64 // satoshi per GH/s per day
+	Vip    bool   // pays VIP fee for priority on workers
+
+	// Auto bid, price raised by step up to max price while hashrate
+	// delivered is under target.
+	MaxPrice       uint64
+	PriceStep      uint64
+	TargetHashrate float64 // hashes per second
 
 	// Pool detail
 	Hostname string
@@ -38,8 +50,55 @@ type Order struct {
 	Username string
 	Password string
 
+	// ntime rolling policy of upstream pool, nil for server default.
+	NtimePolicy *NtimePolicy
+
 	State   uint32
 	Created int64
+
+	lock    sync.Mutex
+	spent   float64 // in satoshi
+	rate    *HashrateEstimator
+	starved time.Time // under target hashrate since, guarded by server
+}
+
+var stateNames = map[uint32]string{
+	StateInit:           "init",
+	StateConnected:      "connected",
+	StateBanned:         "banned",
+	StateDead:           "dead",
+	StateWorking:        "working",
+	StatePause:          "pause",
+	StateClosedCannel:   "closed_cancel",
+	StateClosedComplete: "closed_complete",
+}
+
+func StateName(state uint32) string {
+	name, ok := stateNames[state]
+	if !ok {
+		return "unknown"
+	}
+	return name
+}
+
+// Legal transitions from each state, closed states are final. Banned
+// orders go back to init when unbanned.
+var stateTransitions = map[uint32][]uint32{
+	StateInit:      {StateConnected, StateDead, StateBanned, StateClosedCannel},
+	StateConnected: {StateWorking, StatePause, StateDead, StateBanned, StateClosedCannel, StateClosedComplete},
+	StateWorking:   {StateConnected, StatePause, StateDead, StateBanned, StateClosedCannel, StateClosedComplete},
+	StatePause:     {StateConnected, StateDead, StateBanned, StateClosedCannel},
+	StateDead:      {StateConnected, StateBanned, StateClosedCannel},
+	StateBanned:    {StateInit, StateClosedCannel},
+}
+
+func legalTransition(from, to uint32) bool {
+	for _, state := range stateTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
 }
 
 func InitOrders(algo string) map[uint64]*Order {
@@ -59,17 +118,128 @@ func InitOrders(algo string) map[uint64]*Order {
 	orders := make(map[uint64]*Order)
 	orders[od.Id] = od
 	return orders
-
 }
 
 func (od *Order) Address() string {
 	return fmt.Sprintf("%s:%s", od.Hostname, od.Port)
 }
 
+func (od *Order) algorithm() *Algorithm {
+	algo, err := FindAlgorithm(od.Algorithm)
+	if err != nil {
+		return SHA256
+	}
+	return algo
+}
+
+// estimator of order created on first use, orders may be decoded from
+// config.
+func (od *Order) estimator() *HashrateEstimator {
+	od.lock.Lock()
+	defer od.lock.Unlock()
+	if od.rate == nil {
+		od.rate = NewHashrateEstimator(od.algorithm(), DefaultHashrateTau, time.Now())
+	}
+	return od.rate
+}
+
+// addShare records accepted share for hashrate delivered to order.
+func (od *Order) addShare(difficulty float64, now time.Time) {
+	od.estimator().Add(difficulty, now)
+}
+
+// charge charges order for hashes of a share accepted by upstream at order
+// price, returns satoshi charged.
+func (od *Order) charge(difficulty float64) float64 {
+	hashes := difficulty * od.algorithm().HashesPerShare()
+	cost := hashes / 1e9 / 86400 * float64(od.price())
+	od.lock.Lock()
+	od.spent += cost
+	od.lock.Unlock()
+	return cost
+}
+
+// Hashrate delivered to order.
+func (od *Order) Hashrate() Hashrate {
+	return od.estimator().Hashrate(time.Now())
+}
+
+// price returns current price of order, raised by auto bid.
+func (od *Order) price() uint64 {
+	od.lock.Lock()
+	defer od.lock.Unlock()
+	return od.Price
+}
+
+// Spent returns satoshi spent on hashes delivered.
+func (od *Order) Spent() float64 {
+	od.lock.Lock()
+	defer od.lock.Unlock()
+	return od.spent
+}
+
+// exhausted returns true if order spent its amount, 0 amount is unlimited.
+func (od *Order) exhausted() bool {
+	return od.Amount > 0 && od.Spent() >= float64(od.Amount)
+}
+
+func (od *Order) state() uint32 {
+	od.lock.Lock()
+	defer od.lock.Unlock()
+	return od.State
+}
+
+// setState moves order to state, publishes transition.
+func (od *Order) setState(to uint32) error {
+	od.lock.Lock()
+	from := od.State
+	if !legalTransition(from, to) {
+		od.lock.Unlock()
+		return fmt.Errorf("Order #%d can not go from %s to %s.", od.Id, StateName(from), StateName(to))
+	}
+	od.State = to
+	od.lock.Unlock()
+
+	log.Printf("[Order] #%d %s -> %s.", od.Id, StateName(from), StateName(to))
+	publishEvent(EventPoolState, &PoolStateEvent{od.Id, StateName(to), StateName(from)})
+	return nil
+}
+
+// acceptsWorkers returns true if workers can be bound to order.
+func (od *Order) acceptsWorkers() bool {
+	state := od.state()
+	return state == StateConnected || state == StateWorking
+}
+
+// live returns true if connectivity of order is tracked, states of
+// paused, banned and closed orders change by server only.
+func (od *Order) live() bool {
+	switch od.state() {
+	case StateInit, StateConnected, StateWorking, StateDead:
+		return true
+	}
+	return false
+}
+
 func (od *Order) markDead() {
-	od.State = StateDead
+	if od.live() {
+		od.setState(StateDead)
+	}
 }
 
 func (od *Order) markConnected() {
-	od.State = StateConnected
+	if od.live() {
+		od.setState(StateConnected)
+	}
+}
+
+// markWorkers moves order between connected and working by number of
+// workers bound.
+func (od *Order) markWorkers(count int) {
+	state := od.state()
+	if count > 0 && state == StateConnected {
+		od.setState(StateWorking)
+	} else if count == 0 && state == StateWorking {
+		od.setState(StateConnected)
+	}
 }
@@ -3,12 +3,16 @@ package stratum
 import (
 	"errors"
 	"fmt"
+	"github.com/yinhm/ninepool/birpc"
 	"log"
 	"net"
 	"sync"
 	"time"
 )
 
+var ErrPoolLost = errors.New("Lost connection to pool.")
+var ErrPoolDraining = errors.New("Pool draining, share not submitted.")
+
 type Pool struct {
 	lock       sync.Mutex
 	id         uint64
@@ -16,13 +20,22 @@ type Pool struct {
 	order      *Order
 	upstream   *StratumClient
 	workers    map[*Worker]bool
-	jobs       map[string]*Job
+	wlock      sync.Mutex // guards workers
+	jobs       map[string]*Job // keyed by proxy job id
+	jobIds     []string        // proxy job ids, oldest first
 	CurrentJob *Job
+	generation uint32 // bumped on every upstream reconnect
 	active     bool
 	stable     bool
 	closing    bool
 
 	nonceCounter NonceCounter
+	jobCounter   *JobIdCounter
+	submits      sync.WaitGroup // outstanding upstream submits
+	draining     bool           // no more submits, guarded by lock
+	results      []bool         // last upstream results counted, guarded by lock
+	rejects      int            // rejects in results, guarded by lock
+	rate         *HashrateEstimator
 }
 
 func NewPool(order *Order, errch chan error) (pool *Pool, err error) {
@@ -32,6 +45,11 @@ func NewPool(order *Order, errch chan error) (pool *Pool, err error) {
 	}
 
 	upstream := NewClient(conn, errch)
+	err = upstream.Configure(DefaultVersionMask)
+	if err != nil {
+		return nil, err
+	}
+
 	err = upstream.Subscribe()
 	if err != nil {
 		return nil, err
@@ -39,6 +57,7 @@ func NewPool(order *Order, errch chan error) (pool *Pool, err error) {
 
 	err = upstream.Authorize(order.Username, order.Password)
 	if err != nil {
+		upstream.Close()
 		return nil, err
 	}
 
@@ -52,9 +71,8 @@ func FindPool(pid int) (*Pool, bool) {
 
 func NewPoolWithConn(order *Order, upstream *StratumClient, errch chan error) (*Pool, error) {
 	context := upstream.Context()
-	if context.ExtraNonce2Size != ExtraNonce2Size+ExtraNonce3Size {
-		errmsg := fmt.Sprintf("Invalid nonce sizes, must add up to %d", context.ExtraNonce2Size)
-		return nil, errors.New(errmsg)
+	if err := checkNonce2Size(context.ExtraNonce2Size); err != nil {
+		return nil, err
 	}
 
 	p := &Pool{
@@ -65,17 +83,28 @@ func NewPoolWithConn(order *Order, upstream *StratumClient, errch chan error) (*
 		workers:  make(map[*Worker]bool),
 		jobs:     make(map[string]*Job),
 	}
+	p.rate = NewHashrateEstimator(p.algorithm(), DefaultHashrateTau, time.Now())
 
 	p.nonceCounter = NewProxyExtraNonceCounter(context.ExtraNonce1, ExtraNonce2Size, ExtraNonce3Size)
+	p.jobCounter = NewJobIdCounter(p.id, p.generation)
 
 	go p.Serve(DefaultPoolTimeout, errch)
 
-	context.pid = p.id
+	context.setPool(p.id)
 	order.markConnected()
 	p.active = true
 	return p, nil
 }
 
+// checkNonce2Size returns error if extranonce2 of upstream can not be split
+// to proxy extranonce2 and extranonce3 of workers.
+func checkNonce2Size(size int) error {
+	if size != ExtraNonce2Size+ExtraNonce3Size {
+		return fmt.Errorf("Invalid nonce sizes, %d must add up to %d", size, ExtraNonce2Size+ExtraNonce3Size)
+	}
+	return nil
+}
+
 func (p *Pool) Serve(timeout time.Duration, errch chan error) {
 	for {
 		if p.isClosed() {
@@ -91,6 +120,9 @@ func (p *Pool) Serve(timeout time.Duration, errch chan error) {
 		case err := <-errch:
 			log.Printf("Pool %s lost connection: %s, try reconnect...", p.address, err)
 			err = p.reconnect(errch)
+			if err == ErrAuthRejected && DefaultServer != nil {
+				DefaultServer.banOrder(p.order, err.Error())
+			}
 			if err != nil {
 				log.Printf("reconnect to %s failed, shutdown...", p.address)
 				p.Shutdown()
@@ -112,6 +144,16 @@ func (p *Pool) Context() *ClientContext {
 	return p.upstream.Context()
 }
 
+// upstreamDifficulty returns difficulty set by upstream pool, 0 if not
+// known.
+func (p *Pool) upstreamDifficulty() float64 {
+	ctx := p.Context()
+	if ctx == nil {
+		return 0
+	}
+	return ctx.Difficulty()
+}
+
 func (p *Pool) isClosed() bool {
 	if p.upstream == nil {
 		return true
@@ -126,6 +168,9 @@ func (p *Pool) isAvailable() bool {
 	if !p.active {
 		return false
 	}
+	if !p.order.acceptsWorkers() {
+		return false
+	}
 	if p.reachLimit() {
 		return false
 	}
@@ -145,6 +190,11 @@ func (p *Pool) reconnect(errch chan error) error {
 
 	order := p.order
 	order.markDead()
+	if ctx := p.Context(); ctx != nil {
+		if host, port := ctx.Redirect(); host != "" || port != "" {
+			p.address = p.redirect(host, port)
+		}
+	}
 	p.upstream = nil
 	p.active = false
 
@@ -152,12 +202,17 @@ func (p *Pool) reconnect(errch chan error) error {
 	// reconnect between the pool reconnection.
 	p.closeWorkers()
 
-	conn, err := net.Dial("tcp", order.Address())
+	conn, err := net.Dial("tcp", p.address)
 	if err != nil {
 		return err
 	}
 
 	upstream := NewClient(conn, errch)
+	err = upstream.Configure(DefaultVersionMask)
+	if err != nil {
+		return err
+	}
+
 	err = upstream.Subscribe()
 	if err != nil {
 		return err
@@ -165,16 +220,40 @@ func (p *Pool) reconnect(errch chan error) error {
 
 	err = upstream.Authorize(order.Username, order.Password)
 	if err != nil {
+		upstream.Close()
 		return err
 	}
 
+	// jobs from previous connection are meaningless to the new upstream
+	// session, start a new generation of job ids.
+	p.generation += 1
+	p.jobs = make(map[string]*Job)
+	p.jobIds = nil
+	p.CurrentJob = nil
+	p.jobCounter = NewJobIdCounter(p.id, p.generation)
+
 	order.markConnected()
+	upstream.Context().setPool(p.id)
 	p.upstream = upstream
 	p.active = true
 	log.Printf("Pool %s reconnected.", p.address)
 	return nil
 }
 
+// redirect returns address of client.reconnect to host and port, only on
+// the host of order, a pool must not send our hashes elsewhere.
+func (p *Pool) redirect(host, port string) string {
+	order := p.order
+	if host != "" && host != order.Hostname {
+		log.Printf("Pool %s redirect to host %s ignored.", p.address, host)
+		return order.Address()
+	}
+	if port == "" {
+		port = order.Port
+	}
+	return net.JoinHostPort(order.Hostname, port)
+}
+
 func (p *Pool) Shutdown() {
 	if p.upstream == nil {
 		return
@@ -198,26 +277,119 @@ func (p *Pool) Shutdown() {
 }
 
 func (p *Pool) addWorker(worker *Worker) {
+	p.wlock.Lock()
 	p.workers[worker] = true
+	count := len(p.workers)
+	p.wlock.Unlock()
+	p.order.markWorkers(count)
 }
 
 func (p *Pool) removeWorker(worker *Worker) {
+	p.wlock.Lock()
 	_, ok := p.workers[worker]
 	if !ok {
+		p.wlock.Unlock()
 		log.Printf("Work not found in pool %s.", p.address)
 		return
 	}
 	delete(p.workers, worker)
+	count := len(p.workers)
+	p.wlock.Unlock()
+	p.order.markWorkers(count)
+}
+
+// releaseWorkers asks workers to reconnect, workers are bound to other
+// pools on reconnect.
+func (p *Pool) releaseWorkers() {
+	workers := p.workerList()
+	for _, worker := range workers {
+		worker.Reconnect("", 0, 0)
+	}
+	log.Printf("Released %d workers of pool %s.", len(workers), p.address)
+}
+
+// countUpstream counts upstream result of share, returns true if upstream
+// rejected shares in window over limit. Connection failures, stale (job
+// not found) rejects and low difficulty rejects of shares sent before a
+// new upstream difficulty applied are not counted.
+func (p *Pool) countUpstream(err error) bool {
+	rejected := err == ErrShareRejected
+	if rpcErr, ok := err.(*birpc.Error); ok {
+		switch rpcErr.Code {
+		case ErrorJobNotFound, ErrorLowDifficultyShare:
+			return false
+		}
+		rejected = true
+	}
+	if err != nil && !rejected {
+		return false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.results = append(p.results, rejected)
+	if rejected {
+		p.rejects += 1
+	}
+	if len(p.results) > UpstreamRejectWindow {
+		if p.results[0] {
+			p.rejects -= 1
+		}
+		p.results = p.results[1:]
+	}
+	return p.rejects >= MaxUpstreamRejects &&
+		float64(p.rejects) > MaxUpstreamRejectRatio*float64(len(p.results))
+}
+
+// workerList returns a snapshot of workers bound to pool.
+func (p *Pool) workerList() []*Worker {
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+	workers := make([]*Worker, 0, len(p.workers))
+	for worker, _ := range p.workers {
+		workers = append(workers, worker)
+	}
+	return workers
 }
 
 func (p *Pool) closeWorkers() {
 	// disconnect all workers
-	log.Printf("Closing %d workers.", len(p.workers))
-	for worker, _ := range p.workers {
+	workers := p.workerList()
+	log.Printf("Closing %d workers.", len(workers))
+	for _, worker := range workers {
 		worker.Close()
 	}
 }
 
+// ntimePolicy returns ntime bounds of the upstream pool, server options are
+// used unless order overrides.
+func (p *Pool) ntimePolicy() *NtimePolicy {
+	if p.order.NtimePolicy != nil {
+		return p.order.NtimePolicy
+	}
+	if DefaultServer != nil {
+		return DefaultServer.options.ntimePolicy()
+	}
+	return defaultNtimePolicy()
+}
+
+// versionMask returns version rolling mask negotiated with upstream.
+func (p *Pool) versionMask() uint32 {
+	ctx := p.Context()
+	if ctx == nil {
+		return 0
+	}
+	return ctx.versionMask()
+}
+
+// narrowVersionMask restricts version rolling of workers to mask set by
+// upstream.
+func (p *Pool) narrowVersionMask(mask uint32) {
+	for _, worker := range p.workerList() {
+		worker.narrowVersionMask(mask)
+	}
+}
+
 func (p *Pool) nextNonce1() string {
 	return p.nonceCounter.Next()
 }
@@ -226,35 +398,170 @@ func (p *Pool) nonce2Size() int {
 	return p.nonceCounter.Nonce2Size()
 }
 
-func (p *Pool) newJob(job *Job) {
+// newJob remaps upstream job to proxy job id and broadcast it to workers.
+func (p *Pool) newJob(upstreamJob *Job) {
+	p.lock.Lock()
+	job := upstreamJob.remap(p.jobCounter.Next())
 	if job.CleanJobs {
 		p.jobs = make(map[string]*Job)
+		p.jobIds = nil
 	}
 	p.jobs[job.JobId] = job
+	p.jobIds = append(p.jobIds, job.JobId)
+	for len(p.jobIds) > MaxPoolJobs {
+		delete(p.jobs, p.jobIds[0])
+		p.jobIds = p.jobIds[1:]
+	}
 	p.CurrentJob = job
+	p.lock.Unlock()
+
 	go p.broadcast(job)
 }
 
+// findJob looks up job by proxy job id.
+func (p *Pool) findJob(jobId string) (*Job, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	job, ok := p.jobs[jobId]
+	return job, ok
+}
+
 // broadcast mining jobs
 func (p *Pool) broadcast(job *Job) {
-	for worker, _ := range p.workers {
+	start := time.Now()
+	workers := p.workerList()
+	for _, worker := range workers {
 		worker.sendJob(job)
 	}
-	log.Printf("Broadcast job from %s to %d workers.", p.address, len(p.workers))
+	serverMetrics().jobBroadcast(p.id, time.Since(start))
+	publishEvent(EventJob, &JobEvent{
+		Order:     p.id,
+		JobId:     job.JobId,
+		CleanJobs: job.CleanJobs,
+		Workers:   len(workers),
+	})
+	log.Printf("Broadcast job from %s to %d workers.", p.address, len(workers))
 }
 
-// submit job to upstream
-func (p *Pool) submit(jobId, extraNonce1, extraNonce2, ntime, nonce, hash string) {
-	ctx := p.Context()
-	if ctx == nil {
+func (p *Pool) workerCount() int {
+	p.wlock.Lock()
+	defer p.wlock.Unlock()
+	return len(p.workers)
+}
+
+func (p *Pool) algorithm() *Algorithm {
+	algo, err := FindAlgorithm(p.order.Algorithm)
+	if err != nil {
+		return SHA256
+	}
+	return algo
+}
+
+// addShare records accepted share for hashrate of pool and order.
+func (p *Pool) addShare(difficulty float64, now time.Time) {
+	p.rate.Add(difficulty, now)
+	p.order.addShare(difficulty, now)
+}
+
+// charge bills order for share accepted by upstream and credits the seller
+// mined it, order completes once its amount spent.
+func (p *Pool) charge(share *ShareRecord) {
+	cost := p.order.charge(share.Difficulty)
+	if DefaultServer == nil {
+		return
+	}
+	address, _, _ := parseUsername(share.Worker)
+	DefaultServer.ledger.Credit(p.order, address, cost)
+	if p.order.exhausted() {
+		go DefaultServer.completeOrder(p.order)
+	}
+}
+
+func (p *Pool) hashrate() Hashrate {
+	return p.rate.Hashrate(time.Now())
+}
+
+// submitAsync submits share to upstream in background, tracked so that
+// drain waits for it. Share record if not nil is logged pending, then
+// logged again with upstream result, and charged if upstream accepted.
+// Returns ErrPoolDraining once drain started waiting submits.
+func (p *Pool) submitAsync(job *Job, extraNonce1, extraNonce2, ntime, nonce, versionBits, hash string, share *ShareRecord) error {
+	p.lock.Lock()
+	if p.draining {
+		p.lock.Unlock()
+		return ErrPoolDraining
+	}
+	p.submits.Add(1)
+	p.lock.Unlock()
+
+	if share != nil {
+		share.Upstream = UpstreamPending
+		DefaultServer.logShare(share)
+	}
+	go func() {
+		defer p.submits.Done()
+		err := p.submit(job, extraNonce1, extraNonce2, ntime, nonce, versionBits, hash)
+		if share == nil {
+			return
+		}
+		// only shares passed proxy validation count, a miner must never
+		// get order banned by garbage shares.
+		if p.countUpstream(err) && DefaultServer != nil {
+			DefaultServer.banOrder(p.order, "shares rejected by upstream")
+		}
+		if err == nil {
+			p.charge(share)
+		}
+		result := *share
+		result.Upstream = UpstreamAccepted
+		if err != nil {
+			result.Upstream = UpstreamRejected
+			result.UpstreamError = err.Error()
+		}
+		DefaultServer.logShare(&result)
+	}()
+	return nil
+}
+
+// waitSubmits refuses new submits and waits outstanding upstream submits
+// until timeout, returns false if timed out.
+func (p *Pool) waitSubmits(timeout time.Duration) bool {
+	p.lock.Lock()
+	p.draining = true
+	p.lock.Unlock()
+
+	done := make(chan bool, 1)
+	go func() {
+		p.submits.Wait()
+		done <- true
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// submit job to upstream, proxy job id translated to upstream job id.
+func (p *Pool) submit(job *Job, extraNonce1, extraNonce2, ntime, nonce, versionBits, hash string) error {
+	// upstream is swapped on reconnect
+	p.lock.Lock()
+	upstream := p.upstream
+	p.lock.Unlock()
+	if upstream == nil {
 		log.Printf("share can not submit, lost connection to pool\n")
+		return ErrPoolLost
 	}
+	ctx := upstream.Context()
 	nonce2 := p.nonceCounter.Nonce1Suffix(extraNonce1) + extraNonce2
-	err := p.upstream.Submit(ctx.Username, jobId, nonce2, ntime, nonce)
-	// TODO: log upstream acceptence
+	start := time.Now()
+	err := upstream.Submit(ctx.Username, job.UpstreamJobId, nonce2, ntime, nonce, versionBits)
+	serverMetrics().upstreamShare(p.id, err == nil, time.Since(start))
 	if err != nil {
 		log.Printf("[Pool] share rejected %s, %s.", hash, err.Error())
-		return
+		return err
 	}
 	log.Printf("[Pool] share accepted: %s\n", hash)
+	return nil
 }
@@ -0,0 +1,240 @@
+package stratum
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Steps of pool check, in order run. Check stops at the first step failed.
+const (
+	CheckConnect    = "connect"
+	CheckConfigure  = "configure"
+	CheckSubscribe  = "subscribe"
+	CheckAuthorize  = "authorize"
+	CheckExtraNonce = "extranonce2"
+	CheckJob        = "job"
+)
+
+var (
+	ErrPoolCheckTimeout = errors.New("Pool check timeout.")
+	ErrPoolCheckTarget  = errors.New("Pool check of private address not allowed.")
+)
+
+// Networks pool check of orders not configured never connects to, the API
+// must not probe hosts inside the network of proxy.
+var privateNetworks, _ = NewBanList([]string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+})
+
+type dialFunc func(network, address string, timeout time.Duration) (net.Conn, error)
+
+// CheckStep is result of a step of pool check.
+type CheckStep struct {
+	Name    string
+	Ok      bool
+	Error   string `json:",omitempty"`
+	Elapsed Duration
+}
+
+// PoolCheck reports if upstream pool of an order is reachable, takes its
+// credentials and sends work a proxy can split among workers.
+type PoolCheck struct {
+	Order           uint64
+	Address         string
+	Ok              bool
+	Steps           []CheckStep
+	ExtraNonce1     string  `json:",omitempty"`
+	ExtraNonce2Size int     `json:",omitempty"`
+	VersionMask     uint32  `json:",omitempty"`
+	Difficulty      float64 `json:",omitempty"`
+	JobId           string  `json:",omitempty"` // first job received
+	Message         string  `json:",omitempty"` // client.show_message of pool
+
+	err error // of step failed
+}
+
+// step records result of a step, returns false if failed.
+func (c *PoolCheck) step(name string, started time.Time, err error) bool {
+	step := CheckStep{
+		Name:    name,
+		Ok:      err == nil,
+		Elapsed: Duration(time.Since(started)),
+	}
+	if err != nil {
+		step.Error = err.Error()
+		c.err = err
+	}
+	c.Steps = append(c.Steps, step)
+	return err == nil
+}
+
+// CheckPool connects to upstream pool of order as NewPool does, and waits
+// for a first job. Connection is closed when done, order never goes live.
+func CheckPool(order *Order, timeout time.Duration) *PoolCheck {
+	return checkPool(order, timeout, net.DialTimeout)
+}
+
+func checkPool(order *Order, timeout time.Duration, dial dialFunc) *PoolCheck {
+	check := &PoolCheck{Order: order.Id, Address: order.Address()}
+	started := time.Now()
+	conn, err := dial("tcp", order.Address(), timeout)
+	if !check.step(CheckConnect, started, err) {
+		return check
+	}
+	return checkPoolConn(check, order, conn, timeout-time.Since(started))
+}
+
+// CheckPoolWithConn checks upstream pool of order connected by conn.
+func CheckPoolWithConn(order *Order, conn net.Conn, timeout time.Duration) *PoolCheck {
+	check := &PoolCheck{Order: order.Id, Address: order.Address()}
+	return checkPoolConn(check, order, conn, timeout)
+}
+
+func checkPoolConn(check *PoolCheck, order *Order, conn net.Conn, timeout time.Duration) *PoolCheck {
+	deadline := time.Now().Add(timeout)
+	errch := make(chan error, 1)
+	upstream := NewClient(conn, errch)
+	ctx := upstream.Context()
+	defer func() {
+		check.Message = ctx.Message
+		upstream.Close()
+		// unblock notify of jobs never consumed
+		for {
+			select {
+			case <-ctx.JobCh:
+			case <-time.After(DrainPollInterval):
+				return
+			}
+		}
+	}()
+
+	// bounds next call by time left of check, fails step if none left
+	bound := func(name string, started time.Time) bool {
+		upstream.Timeout = deadline.Sub(started)
+		if upstream.Timeout <= 0 {
+			return check.step(name, started, ErrPoolCheckTimeout)
+		}
+		return true
+	}
+
+	started := time.Now()
+	if !bound(CheckConfigure, started) ||
+		!check.step(CheckConfigure, started, upstream.Configure(DefaultVersionMask)) {
+		return check
+	}
+	check.VersionMask = ctx.versionMask()
+
+	started = time.Now()
+	if !bound(CheckSubscribe, started) ||
+		!check.step(CheckSubscribe, started, upstream.Subscribe()) {
+		return check
+	}
+	check.ExtraNonce1 = ctx.ExtraNonce1
+	check.ExtraNonce2Size = ctx.ExtraNonce2Size
+
+	started = time.Now()
+	if !bound(CheckAuthorize, started) ||
+		!check.step(CheckAuthorize, started, upstream.Authorize(order.Username, order.Password)) {
+		return check
+	}
+
+	started = time.Now()
+	if !check.step(CheckExtraNonce, started, checkNonce2Size(ctx.ExtraNonce2Size)) {
+		return check
+	}
+
+	started = time.Now()
+	var err error
+	select {
+	case job := <-ctx.JobCh:
+		check.JobId = job.JobId
+		err = nil
+	case err = <-errch:
+		if err == nil {
+			err = ErrPoolLost
+		}
+	case <-time.After(deadline.Sub(started)):
+		err = ErrPoolCheckTimeout
+	}
+	check.Difficulty = ctx.Difficulty()
+	check.Ok = check.step(CheckJob, started, err)
+	return check
+}
+
+// dialPublic dials address only if its host resolves to public addresses,
+// the address validated is connected, never resolved again.
+func dialPublic(network, address string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if privateNetworks.BannedAddr(&net.IPAddr{IP: ip}) {
+			return nil, ErrPoolCheckTarget
+		}
+	}
+	return net.DialTimeout(network, net.JoinHostPort(ips[0].String(), port), timeout)
+}
+
+// PoolCheckHandler checks upstream pool of order in json body on POST,
+// or of order by id if given. Pools of orders not configured must be on
+// public addresses. Timeout defaults to DefaultPoolCheckTimeout, capped by
+// MaxPoolCheckTimeout.
+func (s *StratumServer) PoolCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+	timeout := DefaultPoolCheckTimeout
+	if v := params.Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			http.Error(w, "Invalid timeout.", http.StatusBadRequest)
+			return
+		}
+		if timeout > MaxPoolCheckTimeout {
+			timeout = MaxPoolCheckTimeout
+		}
+	}
+
+	dial := dialFunc(net.DialTimeout)
+	var order *Order
+	if v := params.Get("id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id.", http.StatusBadRequest)
+			return
+		}
+		if order, _, err = s.findOrder(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		order = &Order{}
+		if err := json.NewDecoder(r.Body).Decode(order); err != nil ||
+			order.Hostname == "" || order.Port == "" {
+			http.Error(w, "Invalid order.", http.StatusBadRequest)
+			return
+		}
+		dial = dialPublic
+	}
+
+	check := checkPool(order, timeout, dial)
+	if !check.Ok {
+		last := check.Steps[len(check.Steps)-1]
+		log.Printf("[Order] #%d pool %s check failed on %s: %s", order.Id,
+			check.Address, last.Name, last.Error)
+	}
+	writeJson(w, check)
+}
@@ -0,0 +1,343 @@
+package stratum
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const ReservationsName = "reservations.json"
+
+var (
+	ErrReservationCapacity = errors.New("Reservation exceeds available hashrate.")
+	ErrReservationInvalid  = errors.New("Reservation requires hashrate and a future time window.")
+	ErrReservationNotFound = errors.New("Reservation not found.")
+)
+
+// Reservation guarantees an order hashrate in a time window, workers are
+// bound to orders with reservation not met before others.
+type Reservation struct {
+	Id       uint64
+	Order    uint64
+	Hashrate float64 // hashes per second
+	Start    time.Time
+	End      time.Time
+	Created  time.Time
+}
+
+func (r *Reservation) active(now time.Time) bool {
+	return !now.Before(r.Start) && now.Before(r.End)
+}
+
+func (r *Reservation) overlaps(start, end time.Time) bool {
+	return r.Start.Before(end) && start.Before(r.End)
+}
+
+// Reservations of orders, kept as json file saved on every change, in
+// memory only if path is empty. Expired reservations are dropped on save.
+type Reservations struct {
+	lock   sync.Mutex
+	path   string
+	nextId uint64
+	items  []*Reservation
+}
+
+func LoadReservations(path string) (*Reservations, error) {
+	rs := &Reservations{path: path, nextId: 1}
+	if path == "" {
+		return rs, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &rs.items); err != nil {
+		return nil, err
+	}
+	for _, r := range rs.items {
+		if r.Id >= rs.nextId {
+			rs.nextId = r.Id + 1
+		}
+	}
+	return rs, nil
+}
+
+// reserve adds reservation if sum of it and reservations overlapping on
+// orders matched is within capacity.
+func (rs *Reservations) reserve(r *Reservation, capacity float64, match func(orderId uint64) bool) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	reserved := r.Hashrate
+	for _, other := range rs.items {
+		if other.overlaps(r.Start, r.End) && match(other.Order) {
+			reserved += other.Hashrate
+		}
+	}
+	if reserved > capacity {
+		return ErrReservationCapacity
+	}
+
+	r.Id = rs.nextId
+	rs.items = append(rs.items, r)
+	if err := rs.save(); err != nil {
+		rs.items = rs.items[:len(rs.items)-1]
+		return err
+	}
+	rs.nextId += 1
+	return nil
+}
+
+// Active returns hashrate reserved by order now.
+func (rs *Reservations) Active(orderId uint64, now time.Time) float64 {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	sum := 0.0
+	for _, r := range rs.items {
+		if r.Order == orderId && r.active(now) {
+			sum += r.Hashrate
+		}
+	}
+	return sum
+}
+
+// started returns orders of reservations active at now, started or created
+// after since.
+func (rs *Reservations) started(since, now time.Time) []uint64 {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	orders := make([]uint64, 0)
+	for _, r := range rs.items {
+		if r.active(now) && (r.Start.After(since) || r.Created.After(since)) {
+			orders = append(orders, r.Order)
+		}
+	}
+	return orders
+}
+
+// List returns reservations not expired of order, or of all orders if
+// orderId is 0, ordered by start.
+func (rs *Reservations) List(orderId uint64, now time.Time) []Reservation {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	list := []Reservation{}
+	for _, r := range rs.items {
+		if (orderId == 0 || r.Order == orderId) && now.Before(r.End) {
+			list = append(list, *r)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Start.Equal(list[j].Start) {
+			return list[i].Id < list[j].Id
+		}
+		return list[i].Start.Before(list[j].Start)
+	})
+	return list
+}
+
+// Cancel removes reservation by id.
+func (rs *Reservations) Cancel(id uint64) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for i, r := range rs.items {
+		if r.Id == id {
+			rs.items = append(rs.items[:i], rs.items[i+1:]...)
+			return rs.save()
+		}
+	}
+	return ErrReservationNotFound
+}
+
+// save writes reservations to a temp file renamed over.
+func (rs *Reservations) save() error {
+	now := time.Now()
+	items := rs.items[:0]
+	for _, r := range rs.items {
+		if now.Before(r.End) {
+			items = append(items, r)
+		}
+	}
+	rs.items = items
+	if rs.path == "" {
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(rs.items, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := rs.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rs.path)
+}
+
+// Rebalance moves workers to orders of reservations got active since, if
+// hashrate delivered misses hashrate reserved. Workers of other pools on
+// algorithm of order are asked to reconnect, cheapest first, until enough
+// hashrate released. Called periodically by server.
+func (s *StratumServer) Rebalance(since, now time.Time) {
+	for _, orderId := range s.reserves.started(since, now) {
+		s.lock.Lock()
+		pool, ok := s.pools[orderId]
+		s.lock.Unlock()
+		if !ok || !pool.isAvailable() {
+			continue
+		}
+		missing := s.reserves.Active(orderId, now) - pool.hashrate().EMA
+		if missing > 0 {
+			log.Printf("[Order] #%d reservation active, %.0f H/s missing.", orderId, missing)
+			s.releaseWorkers(pool, missing, math.MaxUint64, now)
+		}
+	}
+}
+
+// releaseWorkers asks workers of other pools on algorithm of pool, at price
+// below maxPrice, to reconnect cheapest first until hashrate released. Pools
+// missing their own reservation keep workers.
+func (s *StratumServer) releaseWorkers(pool *Pool, hashrate float64, maxPrice uint64, now time.Time) {
+	pools := s.Pools()
+	sort.Slice(pools, func(i, j int) bool { return pools[i].order.price() < pools[j].order.price() })
+	for _, other := range pools {
+		if other == pool || other.algorithm() != pool.algorithm() || other.order.price() >= maxPrice ||
+			s.reserves.Active(other.id, now) > other.hashrate().EMA {
+			continue
+		}
+		for _, worker := range other.workerList() {
+			if hashrate <= 0 {
+				return
+			}
+			if worker.context.listener == nil || worker.context.listener.eligible(pool.order) {
+				hashrate -= worker.Hashrate().EMA
+				worker.Reconnect("", 0, 0)
+			}
+		}
+	}
+}
+
+func (s *StratumServer) reservationLoop() {
+	ticker := time.NewTicker(ReservationInterval)
+	defer ticker.Stop()
+	since := time.Now()
+	for now := range ticker.C {
+		s.lock.Lock()
+		closing := s.closing
+		s.lock.Unlock()
+		if closing {
+			return
+		}
+		s.Rebalance(since, now)
+		since = now
+	}
+}
+
+// Capacity returns hashrate of workers connected on algorithm.
+func (s *StratumServer) Capacity(algorithm string) float64 {
+	capacity := 0.0
+	for _, worker := range s.Workers() {
+		if worker.context.algorithm != nil && worker.context.algorithm.Name == algorithm {
+			capacity += worker.Hashrate().EMA
+		}
+	}
+	return capacity
+}
+
+// Reserve adds reservation of order if hashrate of workers on algorithm of
+// order can serve it along with reservations overlapping.
+func (s *StratumServer) Reserve(r *Reservation) error {
+	now := time.Now()
+	if r.Hashrate <= 0 || !r.End.After(r.Start) || !r.End.After(now) {
+		return ErrReservationInvalid
+	}
+
+	s.lock.Lock()
+	order, ok := s.orders[r.Order]
+	algorithms := make(map[uint64]string, len(s.orders))
+	for id, o := range s.orders {
+		algorithms[id] = o.algorithm().Name
+	}
+	s.lock.Unlock()
+	if !ok {
+		return ErrOrderNotFound
+	}
+
+	algorithm := order.algorithm().Name
+	r.Created = now
+	err := s.reserves.reserve(r, s.Capacity(algorithm), func(orderId uint64) bool {
+		return algorithms[orderId] == algorithm
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[Order] #%d reserved %.0f H/s from %s to %s.", r.Order, r.Hashrate,
+		r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339))
+	return nil
+}
+
+// Reservations of server.
+func (s *StratumServer) Reservations() *Reservations {
+	return s.reserves
+}
+
+// ReservationsHandler lists reservations on GET, filtered by order if
+// given, creates reservation of json body on POST and cancels reservation
+// by id on DELETE.
+func (s *StratumServer) ReservationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		var orderId uint64
+		if v := r.URL.Query().Get("order"); v != "" {
+			var err error
+			if orderId, err = strconv.ParseUint(v, 10, 64); err != nil {
+				http.Error(w, "Invalid order.", http.StatusBadRequest)
+				return
+			}
+		}
+		writeJson(w, s.reserves.List(orderId, time.Now()))
+	case "POST":
+		reservation := &Reservation{}
+		if err := json.NewDecoder(r.Body).Decode(reservation); err != nil {
+			http.Error(w, "Invalid reservation.", http.StatusBadRequest)
+			return
+		}
+		switch err := s.Reserve(reservation); err {
+		case nil:
+			writeJson(w, reservation)
+		case ErrReservationCapacity:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case ErrReservationInvalid, ErrOrderNotFound:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			log.Printf("Failed to save reservations: %s", err)
+			http.Error(w, "Reservation error.", http.StatusInternalServerError)
+		}
+	case "DELETE":
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id.", http.StatusBadRequest)
+			return
+		}
+		switch err := s.reserves.Cancel(id); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case ErrReservationNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			log.Printf("Failed to save reservations: %s", err)
+			http.Error(w, "Reservation error.", http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
@@ -1,6 +1,7 @@
 package stratum
 
 import (
+	"crypto/subtle"
 	"errors"
 	"github.com/tv42/topic"
 	"github.com/yinhm/ninepool/birpc"
@@ -8,25 +9,48 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var ErrServerUnexpected = errors.New("Server error.")
 var DefaultServer *StratumServer
 
+// Flusher is a store buffering writes, flushed when server drains.
+type Flusher interface {
+	Flush() error
+}
+
 type StratumServer struct {
 	lock sync.Mutex
 	*Stratum
-	options Options
-	workers map[*birpc.Endpoint]*Worker
-	pools   map[uint64]*Pool
-	perrchs map[uint64]chan error // pool error chans
-	orders  map[uint64]*Order
-	errCh   chan error
-	sigCh   chan os.Signal
-	closing bool
+	options   Options
+	workers   map[*birpc.Endpoint]*Worker
+	pools     map[uint64]*Pool
+	perrchs   map[uint64]chan error // pool error chans
+	orders    map[uint64]*Order
+	blocks    []*BlockCandidate
+	notifiers []BlockNotifier
+	listeners []*Listener
+	flushers  []Flusher
+	metrics   *Metrics
+	dashboard *birpc.Registry               // services of dashboard websocket
+	names     map[string]*HashrateEstimator // hashrate by address.worker
+	bans      *BanList
+	shares    *ShareLog
+	ledger    *Ledger
+	reserves  *Reservations // served before price when binding workers
+	errCh     chan error
+	sigCh     chan os.Signal
+	closing   bool
 }
 
 func NewStratumServer(options Options) *StratumServer {
@@ -34,45 +58,125 @@ func NewStratumServer(options Options) *StratumServer {
 		broadcast: topic.New(),
 		registry:  birpc.NewRegistry(),
 	}
+	options.setTimeouts()
+	if options.MinPayout == 0 {
+		options.MinPayout = DefaultMinPayout
+	}
+	if options.Fees == nil {
+		fees := DefaultFeeSchedule()
+		options.Fees = &fees
+	}
+	if options.VipCapRatio == 0 {
+		options.VipCapRatio = DefaultVipCapRatio
+	}
+	if options.AutoBidPeriod == 0 {
+		options.AutoBidPeriod = DefaultAutoBidPeriod
+	}
+	bans, err := NewBanList(options.Bans)
+	if err != nil {
+		log.Printf("Ignored invalid ban list: %s", err)
+	}
+
+	// demo order of the first algorithm served unless orders configured
+	orders := InitOrders(options.algorithms()[0])
+	if len(options.Orders) > 0 {
+		orders = make(map[uint64]*Order)
+		for _, order := range options.Orders {
+			orders[order.Id] = order
+		}
+	}
+
 	DefaultServer = &StratumServer{
-		Stratum: s,
-		options: options,
-		workers: make(map[*birpc.Endpoint]*Worker),
-		pools:   make(map[uint64]*Pool),
-		perrchs: make(map[uint64]chan error),
-		orders:  InitOrders("x11"),
-		errCh:   make(chan error),
-		sigCh:   make(chan os.Signal),
+		Stratum:   s,
+		options:   options,
+		workers:   make(map[*birpc.Endpoint]*Worker),
+		pools:     make(map[uint64]*Pool),
+		perrchs:   make(map[uint64]chan error),
+		orders:    orders,
+		bans:      bans,
+		metrics:   NewMetrics(),
+		dashboard: birpc.NewRegistry(),
+		names:     make(map[string]*HashrateEstimator),
+		errCh:     make(chan error),
+		sigCh:     make(chan os.Signal),
 	}
 	mining := &Mining{}
 	// ss.registry.RegisterService(ss)
 	DefaultServer.registry.RegisterService(mining)
+	DefaultServer.dashboard.RegisterService(&Dashboard{DefaultServer})
+	ledgerPath, reservationsPath := "", ""
+	if options.DataDir != "" {
+		shares, err := OpenShareLog(filepath.Join(options.DataDir, "shares"), MaxShareLogSize)
+		if err != nil {
+			log.Printf("Share log disabled: %s", err)
+		} else {
+			DefaultServer.shares = shares
+			DefaultServer.AddFlusher(shares)
+		}
+		ledgerPath = filepath.Join(options.DataDir, LedgerName)
+		reservationsPath = filepath.Join(options.DataDir, ReservationsName)
+	}
+	ledger, err := NewLedger(ledgerPath, options.MinPayout, *options.Fees)
+	if err != nil {
+		// never start over an unreadable ledger, balances would be lost
+		log.Fatalf("Failed to load ledger %s: %s", ledgerPath, err)
+	}
+	DefaultServer.ledger = ledger
+	DefaultServer.AddFlusher(ledger)
+	reservations, err := LoadReservations(reservationsPath)
+	if err != nil {
+		log.Fatalf("Failed to load reservations %s: %s", reservationsPath, err)
+	}
+	DefaultServer.reserves = reservations
+	if options.BlockNotify != "" {
+		DefaultServer.OnBlockCandidate(BlockNotifyCommand(options.BlockNotify))
+	}
 	return DefaultServer
 }
 
-func (s *StratumServer) Start(l net.Listener) error {
+// Start serves listeners until a signal is received or got an error.
+func (s *StratumServer) Start(listeners ...*Listener) error {
 	defer s.close()
 
+	s.lock.Lock()
+	s.listeners = listeners
+	s.lock.Unlock()
+
 	go s.startPools()
-	go s.serve(l)
+	go s.flushLoop()
+	go s.autoBidLoop()
+	go s.reservationLoop()
+	if s.options.HttpAddress != "" {
+		go s.serveHttp(s.options.HttpAddress)
+	}
+	for _, l := range listeners {
+		log.Printf("Listen on %s", l.Options)
+		go s.serve(l)
+	}
 
-	signal.Notify(s.sigCh, os.Interrupt, os.Kill)
+	signal.Notify(s.sigCh, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Block until a signal is received or we got an error
-	select {
-	case signal := <-s.sigCh:
-		log.Printf("Got signal %s, waiting for shutdown...", signal)
-		s.Shutdown()
-		return nil
-	case err := <-s.errCh:
-		log.Printf("Server shutdown with error: %s", err)
-		s.Shutdown()
-		return err
+	for {
+		select {
+		case signal := <-s.sigCh:
+			if signal == syscall.SIGHUP {
+				s.reloadConfig()
+				continue
+			}
+			log.Printf("Got signal %s, waiting for shutdown...", signal)
+			s.Drain(s.options.DrainTimeout)
+			return nil
+		case err := <-s.errCh:
+			log.Printf("Server shutdown with error: %s", err)
+			s.Shutdown()
+			return err
+		}
 	}
 	return nil
 }
 
-func (s *StratumServer) serve(l net.Listener) {
+func (s *StratumServer) serve(l *Listener) {
 	for {
 		if s.closing == true {
 			return
@@ -80,20 +184,86 @@ func (s *StratumServer) serve(l net.Listener) {
 
 		conn, err := l.Accept()
 		if err != nil {
+			if s.closing {
+				return
+			}
 			log.Printf("Error on accept connect.")
 			continue
 		}
 
-		go s.ServeConn(conn)
+		go s.serveConn(conn, l.Options)
+	}
+}
+
+// Handler returns handler of metrics, APIs and dashboard. Requests changing
+// state require the admin token.
+func (s *StratumServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.MetricsHandler)
+	mux.HandleFunc("/api/workers", s.WorkersHandler)
+	mux.HandleFunc("/api/workers/notify", s.adminOnly(s.WorkersNotifyHandler))
+	mux.HandleFunc("/api/pools", s.PoolsHandler)
+	mux.HandleFunc("/api/orders", s.OrdersHandler)
+	mux.HandleFunc("/api/orders/state", s.adminOnly(s.OrderStateHandler))
+	mux.HandleFunc("/api/orders/check", s.adminOnly(s.PoolCheckHandler))
+	mux.HandleFunc("/api/names", s.NamesHandler)
+	mux.HandleFunc("/api/shares", s.SharesHandler)
+	mux.HandleFunc("/api/balances", s.BalancesHandler)
+	mux.HandleFunc("/api/payouts", s.adminOnly(s.PayoutsHandler))
+	mux.HandleFunc("/api/reservations", s.adminOnly(s.ReservationsHandler))
+	mux.Handle("/events", s.EventsHandler())
+	mux.HandleFunc("/", s.DashboardHandler)
+	return mux
+}
+
+// adminOnly passes reads through, other methods require header
+// "Authorization: Bearer <AdminToken>". Without a token configured state
+// never changes over http. A header is never sent by browsers on their own,
+// forged cross site requests carry no token.
+func (s *StratumServer) adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			handler(w, r)
+			return
+		}
+		if s.options.AdminToken == "" {
+			http.Error(w, "Admin API disabled.", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.options.AdminToken)) != 1 {
+			http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
 	}
 }
 
+// serveHttp serves metrics and APIs, server stops if address unavailable.
+func (s *StratumServer) serveHttp(address string) {
+	log.Printf("HTTP listen on %s", address)
+	if err := http.ListenAndServe(address, s.Handler()); err != nil {
+		s.errCh <- err
+	}
+}
+
+// ServeConn serves conn with profile of the default listener.
 func (s *StratumServer) ServeConn(conn net.Conn) {
+	s.serveConn(conn, s.options.defaultListener())
+}
+
+func (s *StratumServer) serveConn(conn net.Conn, listener *ListenerOptions) {
 	defer conn.Close()
 
-	endpoint := s.newEndpoint(conn)
+	if s.bannedAddr(conn.RemoteAddr()) {
+		log.Printf("Banned client rejected: %v", conn.RemoteAddr())
+		return
+	}
+
+	endpoint := s.newEndpoint(conn, listener)
 
 	log.Printf("Client connected: %v\n", conn.RemoteAddr())
+	publishEvent(EventWorkerConnect, &WorkerEvent{RemoteAddr: conn.RemoteAddr().String()})
 	err := endpoint.Serve()
 	if err != nil {
 		if err == io.EOF {
@@ -109,12 +279,18 @@ func (s *StratumServer) ServeConn(conn net.Conn) {
 	worker.Close()
 	delete(s.workers, endpoint)
 	s.lock.Unlock()
+	publishEvent(EventWorkerDisconnect, &WorkerEvent{
+		RemoteAddr: conn.RemoteAddr().String(),
+		Name:       worker.context.Username,
+	})
 }
 
-func (s *StratumServer) newEndpoint(conn net.Conn) *birpc.Endpoint {
+func (s *StratumServer) newEndpoint(conn net.Conn, listener *ListenerOptions) *birpc.Endpoint {
 	ep := birpc.NewEndpoint(jsonmsg.NewCodec(conn), s.registry)
-	worker := NewWorker(ep, s.options.SubscribeTimeout)
 	s.lock.Lock()
+	worker := NewWorker(ep, s.options.SubscribeTimeout)
+	worker.setListener(listener)
+	worker.context.RemoteAddress = conn.RemoteAddr().String()
 	s.workers[ep] = worker
 	s.lock.Unlock()
 	return ep
@@ -126,18 +302,45 @@ func (s *StratumServer) AddOrder(order *Order) {
 	s.lock.Unlock()
 }
 
+// startPools activates orders concurrently, check of a new order's pool
+// may take up to DefaultPoolCheckTimeout.
 func (s *StratumServer) startPools() {
+	s.lock.Lock()
+	orders := make([]*Order, 0, len(s.orders))
 	for _, order := range s.orders {
-		s.activeOrder(order)
+		orders = append(orders, order)
+	}
+	s.lock.Unlock()
+	for _, order := range orders {
+		go s.activeOrder(order)
 	}
 }
 
 func (s *StratumServer) activeOrder(order *Order) {
 	// test if actived
+	s.lock.Lock()
 	_, ok := s.pools[order.Id]
+	s.lock.Unlock()
 	if ok {
 		return
 	}
+	switch order.state() {
+	case StateBanned, StateClosedCannel, StateClosedComplete:
+		return
+	case StateInit:
+		// new order goes live only if its pool passes check
+		if check := CheckPool(order, DefaultPoolCheckTimeout); !check.Ok {
+			last := check.Steps[len(check.Steps)-1]
+			log.Printf("[Order] #%d pool %s check failed on %s: %s", order.Id,
+				check.Address, last.Name, last.Error)
+			if check.err == ErrAuthRejected {
+				s.banOrder(order, check.err.Error())
+				return
+			}
+			order.markDead()
+			return
+		}
+	}
 
 	// connect to upstream pool
 	log.Printf("connecting to #%d, %s ...\n", order.Id, order.Address())
@@ -146,6 +349,10 @@ func (s *StratumServer) activeOrder(order *Order) {
 	pool, err := NewPool(order, errch)
 	if err != nil {
 		log.Printf("Failed to connecting the pool %s: %s\n", order.Address(), err.Error())
+		if err == ErrAuthRejected {
+			s.banOrder(order, err.Error())
+			return
+		}
 		order.markDead()
 		return
 	}
@@ -161,10 +368,261 @@ func (s *StratumServer) ActivePool(order *Order, pool *Pool, errch chan error) {
 }
 
 func (s *StratumServer) findPool(oid uint64) (*Pool, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	p, ok := s.pools[oid]
 	return p, ok
 }
 
+// reloadConfig reloads config file on SIGHUP, server keeps running with
+// current settings if config is invalid.
+func (s *StratumServer) reloadConfig() {
+	if s.options.ConfigFile == "" {
+		log.Printf("No config file to reload.")
+		return
+	}
+	config, err := LoadConfig(s.options.ConfigFile)
+	if err != nil {
+		log.Printf("Failed to reload config: %s", err)
+		return
+	}
+	if err := s.Reload(config); err != nil {
+		log.Printf("Failed to reload config: %s", err)
+	}
+}
+
+// Reload applies non-disruptive settings of config: new orders, ban list,
+// vardiff, fees, VIP cap and subscribe timeout. Listeners, storage and other timeouts
+// take effect on restart.
+func (s *StratumServer) Reload(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	bans, err := NewBanList(config.Bans)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	options := s.options
+	options.Listeners = append([]ListenerOptions(nil), s.options.Listeners...)
+	config.Apply(&options)
+	options.setListenerDefaults()
+
+	s.bans = bans
+	if config.Fees != nil {
+		s.options.Fees = options.Fees
+		s.ledger.SetFees(*options.Fees)
+	}
+	if options.VipCapRatio > 0 {
+		s.options.VipCapRatio = options.VipCapRatio
+	}
+	s.options.SubscribeTimeout = options.SubscribeTimeout
+	s.options.Vardiff = options.Vardiff
+	for _, lo := range options.Listeners {
+		for i := range s.options.Listeners {
+			if s.options.Listeners[i].Address == lo.Address {
+				s.options.Listeners[i].Vardiff = lo.Vardiff
+				s.options.Listeners[i].inheritVardiff = lo.inheritVardiff
+			}
+		}
+		for _, l := range s.listeners {
+			if l.Options.Address == lo.Address {
+				l.Options.Vardiff = lo.Vardiff
+				l.Options.inheritVardiff = lo.inheritVardiff
+			}
+		}
+	}
+
+	added := make([]*Order, 0)
+	for _, order := range config.Orders {
+		if _, ok := s.orders[order.Id]; !ok {
+			s.orders[order.Id] = order
+			added = append(added, order)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, order := range added {
+		go s.activeOrder(order)
+	}
+	log.Printf("Config reloaded, %d new orders, %d bans.", len(added), bans.Len())
+	return nil
+}
+
+// vardiffOptions returns vardiff of listener, which may change on reload.
+func (s *StratumServer) vardiffOptions(listener *ListenerOptions) VardiffOptions {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return listener.Vardiff
+}
+
+func (s *StratumServer) bannedAddr(addr net.Addr) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bans.BannedAddr(addr)
+}
+
+func (s *StratumServer) bannedAddress(address string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.bans.BannedAddress(address)
+}
+
+// OnBlockCandidate registers notifier called on every block candidate.
+func (s *StratumServer) OnBlockCandidate(notifier BlockNotifier) {
+	s.lock.Lock()
+	s.notifiers = append(s.notifiers, notifier)
+	s.lock.Unlock()
+}
+
+// BlockCandidates returns recent block candidates, oldest first.
+func (s *StratumServer) BlockCandidates() []*BlockCandidate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	blocks := make([]*BlockCandidate, len(s.blocks))
+	copy(blocks, s.blocks)
+	return blocks
+}
+
+func (s *StratumServer) addBlockCandidate(block *BlockCandidate) {
+	s.lock.Lock()
+	s.blocks = append(s.blocks, block)
+	if len(s.blocks) > MaxBlockCandidates {
+		s.blocks = s.blocks[len(s.blocks)-MaxBlockCandidates:]
+	}
+	notifiers := s.notifiers
+	s.lock.Unlock()
+	publishEvent(EventBlock, block)
+
+	for _, notify := range notifiers {
+		go notify(block)
+	}
+}
+
+// Pools returns a snapshot of pools, ordered by id.
+func (s *StratumServer) Pools() []*Pool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pools := make([]*Pool, 0, len(s.pools))
+	for _, pool := range s.pools {
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].id < pools[j].id })
+	return pools
+}
+
+// addNameShare records accepted share for hashrate of worker name, which
+// may be shared by many connections. Stale names are dropped when a new
+// name is added.
+func (s *StratumServer) addNameShare(name string, algorithm *Algorithm, difficulty float64, now time.Time) {
+	s.lock.Lock()
+	rate, ok := s.names[name]
+	if !ok {
+		s.pruneNames(now)
+		rate = NewHashrateEstimator(algorithm, DefaultHashrateTau, now)
+		s.names[name] = rate
+	}
+	s.lock.Unlock()
+	rate.Add(difficulty, now)
+}
+
+// pruneNames drops names without shares in LongHashrateWindow, called with
+// server locked.
+func (s *StratumServer) pruneNames(now time.Time) {
+	for name, rate := range s.names {
+		if now.Sub(rate.LastShare()) > LongHashrateWindow {
+			delete(s.names, name)
+		}
+	}
+}
+
+// NameHashrates returns hashrate by worker name as "address.worker".
+func (s *StratumServer) NameHashrates() map[string]Hashrate {
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pruneNames(now)
+	rates := make(map[string]Hashrate, len(s.names))
+	for name, rate := range s.names {
+		rates[name] = rate.Hashrate(now)
+	}
+	return rates
+}
+
+// Workers returns a snapshot of connected workers.
+func (s *StratumServer) Workers() []*Worker {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	workers := make([]*Worker, 0, len(s.workers))
+	for _, worker := range s.workers {
+		workers = append(workers, worker)
+	}
+	return workers
+}
+
+// BroadcastMessage shows message on all connected miners.
+func (s *StratumServer) BroadcastMessage(message string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, worker := range s.workers {
+		worker.ShowMessage(message)
+	}
+	log.Printf("Message sent to %d workers: %s", len(s.workers), message)
+}
+
+// RedirectWorkers sends client.reconnect to all connected miners, eg:
+// moving them to another proxy instance during maintenance.
+func (s *StratumServer) RedirectWorkers(hostname string, port int, wait int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, worker := range s.workers {
+		worker.Reconnect(hostname, port, wait)
+	}
+	log.Printf("Redirected %d workers to %s:%d.", len(s.workers), hostname, port)
+}
+
+// WorkersNotifyHandler sends a message to, or redirects, all connected
+// miners, eg: /api/workers/notify?action=redirect&host=proxy2&port=3335.
+func (s *StratumServer) WorkersNotifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	params := r.URL.Query()
+
+	switch params.Get("action") {
+	case "message":
+		message := params.Get("message")
+		if message == "" {
+			http.Error(w, "Invalid message.", http.StatusBadRequest)
+			return
+		}
+		s.BroadcastMessage(message)
+	case "redirect":
+		// empty host or port reconnects to same
+		port, wait := 0, 0
+		var err error
+		if value := params.Get("port"); value != "" {
+			if port, err = strconv.Atoi(value); err != nil || port <= 0 || port > 65535 {
+				http.Error(w, "Invalid port.", http.StatusBadRequest)
+				return
+			}
+		}
+		if value := params.Get("wait"); value != "" {
+			if wait, err = strconv.Atoi(value); err != nil || wait < 0 {
+				http.Error(w, "Invalid wait.", http.StatusBadRequest)
+				return
+			}
+		}
+		s.RedirectWorkers(params.Get("host"), port, wait)
+	default:
+		http.Error(w, "Invalid action.", http.StatusBadRequest)
+		return
+	}
+	writeJson(w, map[string]int{"workers": len(s.Workers())})
+}
+
 func (s *StratumServer) Shutdown() {
 	s.stopListen()
 	// TODO: move stop worker to pool?
@@ -172,8 +630,69 @@ func (s *StratumServer) Shutdown() {
 	s.stopPools()
 }
 
+// AddFlusher registers store flushed on drain.
+func (s *StratumServer) AddFlusher(flusher Flusher) {
+	s.lock.Lock()
+	s.flushers = append(s.flushers, flusher)
+	s.lock.Unlock()
+}
+
+// Drain stops accepting, redirects miners by client.reconnect, waits
+// outstanding upstream submits, flushes stores and then shuts down. Miners
+// still connected and submits not finished by timeout are dropped.
+func (s *StratumServer) Drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	s.stopListen()
+
+	hostname, port := "", 0
+	if s.options.DrainRedirect != "" {
+		host, portStr, err := net.SplitHostPort(s.options.DrainRedirect)
+		if err == nil {
+			hostname = host
+			port, _ = strconv.Atoi(portStr)
+		}
+	}
+	s.RedirectWorkers(hostname, port, 0)
+
+	// miners disconnect themselves on client.reconnect
+	for len(s.Workers()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(DrainPollInterval)
+	}
+	s.lock.Lock()
+	s.stopWorkers()
+	pools := make([]*Pool, 0, len(s.pools))
+	for _, pool := range s.pools {
+		pools = append(pools, pool)
+	}
+	flushers := s.flushers
+	s.lock.Unlock()
+
+	for _, pool := range pools {
+		if !pool.waitSubmits(deadline.Sub(time.Now())) {
+			log.Printf("Drain timeout, outstanding submits to %s dropped.", pool.address)
+		}
+	}
+
+	for _, flusher := range flushers {
+		if err := flusher.Flush(); err != nil {
+			log.Printf("Failed to flush store: %s", err)
+		}
+	}
+
+	s.stopPools()
+	log.Printf("Server drained.")
+}
+
+// stopListen stops accepting, closing listeners unblocks Accept.
 func (s *StratumServer) stopListen() {
+	s.lock.Lock()
 	s.closing = true
+	listeners := s.listeners
+	s.lock.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
 }
 
 func (s *StratumServer) stopPools() {
@@ -190,17 +709,87 @@ func (s *StratumServer) stopWorkers() {
 	}
 }
 
-func (s *StratumServer) firstPool() (*Pool, error) {
+// poolRank orders pools binding workers.
+type poolRank struct {
+	capped   bool // VIP order over VIP cap
+	reserved bool // active reservation not met
+	price    uint64
+	vip      bool
+}
+
+// before returns true if pool of rank r is preferred to pool of rank o.
+func (r poolRank) before(o poolRank) bool {
+	if r.capped != o.capped {
+		return !r.capped
+	}
+	if r.reserved != o.reserved {
+		return r.reserved
+	}
+	if r.price != o.price {
+		return r.price > o.price
+	}
+	return r.vip && !o.vip
+}
+
+// bestPool returns the available pool of highest price among orders
+// eligible on listener. Orders with active reservation not met by hashrate
+// delivered are served first, VIP orders win at equal price. VIP orders over
+// VIP cap of their algorithm get workers only if no other pool is eligible.
+func (s *StratumServer) bestPool(listener *ListenerOptions) (*Pool, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	now := time.Now()
+	vipAllowed := make(map[*Algorithm]bool)
+	var best *Pool
+	var bestRank poolRank
 	for _, pool := range s.pools {
-		if pool.isAvailable() {
-			return pool, nil
+		if !pool.isAvailable() || !listener.eligible(pool.order) {
+			continue
+		}
+		capped := false
+		if pool.order.Vip {
+			algorithm := pool.algorithm()
+			allowed, ok := vipAllowed[algorithm]
+			if !ok {
+				allowed = s.vipAllowed(algorithm)
+				vipAllowed[algorithm] = allowed
+			}
+			capped = !allowed
+		}
+		rank := poolRank{
+			capped:   capped,
+			reserved: s.reserves.Active(pool.id, now) > pool.hashrate().EMA,
+			price:    pool.order.price(),
+			vip:      pool.order.Vip,
+		}
+		if best == nil || rank.before(bestRank) || (rank == bestRank && pool.id < best.id) {
+			best = pool
+			bestRank = rank
 		}
 	}
 
-	return nil, errors.New("No pool available.")
+	if best == nil {
+		return nil, errors.New("No pool available.")
+	}
+	return best, nil
+}
+
+// vipAllowed returns true if hashrate of VIP orders on algorithm is under
+// VIP cap of total hashrate on algorithm, called with server locked.
+func (s *StratumServer) vipAllowed(algorithm *Algorithm) bool {
+	total, vip := 0.0, 0.0
+	for _, pool := range s.pools {
+		if pool.algorithm() != algorithm {
+			continue
+		}
+		hashrate := pool.hashrate().EMA
+		total += hashrate
+		if pool.order.Vip {
+			vip += hashrate
+		}
+	}
+	return vip == 0 || vip < total*s.options.VipCapRatio
 }
 
 // func (s *StratumServer) Connection(e *birpc.Endpoint) (conn *Connection, err error) {
@@ -1,10 +1,24 @@
 package stratum_test
 
 import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/yinhm/ninepool/birpc"
+	"github.com/yinhm/ninepool/birpc/oneshotlisten"
 	"github.com/yinhm/ninepool/stratum"
+	"github.com/yinhm/ninepool/stratum/stratumtest"
 	"io"
+	"io/ioutil"
+	"math"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -27,47 +41,56 @@ func initServer() {
 	go server.ServeConn(srv)
 }
 
-func addOrder() {
-	order := &stratum.Order{
-		Id:       1,
-		Hostname: "112.124.104.176",
-		Port:     "3333",
-		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
-		Password: "x",
-	}
+func addOrder() *stratumtest.Pool {
+	return addAlgorithmOrder("")
+}
+
+func addAlgorithmOrder(algorithm string) *stratumtest.Pool {
+	return addMockOrder(&stratum.Order{
+		Id:        1,
+		Algorithm: algorithm,
+		Username:  "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password:  "x",
+	})
+}
+
+// fake upstream pools, closed with server
+var fakes []*stratumtest.Pool
+
+// addMockOrder activates order with upstream of a fake pool.
+func addMockOrder(order *stratum.Order) *stratumtest.Pool {
+	return addFakeOrder(order, stratumtest.Options{VersionMask: 0x1fffe000})
+}
+
+// addFakeOrder activates order with upstream of a fake pool of opts,
+// returns after first job received.
+func addFakeOrder(order *stratum.Order, opts stratumtest.Options) *stratumtest.Pool {
+	fake := stratumtest.NewPool(opts)
+	fakes = append(fakes, fake)
+	order.Hostname = fake.Host()
+	order.Port = fake.Port()
 	server.AddOrder(order)
 
-	// active mock order
-	pcli, _ := net.Pipe()
 	errch := make(chan error, 1)
-	upstream := stratum.NewClient(pcli, errch)
-	ctx := upstream.Context()
-	ctx.ExtraNonce1 ="08000002"
-	ctx.ExtraNonce2Size = 4
-
-	list := birpc.List{
-		"bf",
-		"4d16b6f85af6e2198f44ae2a6de67f78487ae5611b77c6c0440b921e00000000",
-		"01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff20020862062f503253482f04b8864e5008",
-		"072f736c7573682f000000000100f2052a010000001976a914d23fcdf86f7e756a64a7a9688ef9903327048ed988ac00000000",
-		birpc.List{},
-		"00000002",
-		"1c2ac4af",
-		"504e86b9",
-		false,
+	p, err := stratum.NewPool(order, errch)
+	if err != nil {
+		panic(err)
 	}
-	newJob, _ := stratum.NewJob(list)
-	ctx.JobCh <- newJob
-
-	p, _ := stratum.NewPoolWithConn(order, upstream, errch)
 	server.ActivePool(order, p, errch)
-	// _ = p.Context()
+	for i := 0; i < 100 && !opts.ManualJobs && p.CurrentJob == nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	return fake
 }
 
 func closeServer() {
 	server.Shutdown()
 	cli.Close()
 	srv.Close()
+	for _, fake := range fakes {
+		fake.Close()
+	}
+	fakes = nil
 }
 
 func TestSubscribe(t *testing.T) {
@@ -135,10 +158,10 @@ func TestSetDifficulty(t *testing.T) {
 
 	time.Sleep(20 * time.Millisecond) // wait for notification
 	ctx := client.Context()
-	if ctx.Difficulty != stratum.DefaultDifficulty {
+	if ctx.Difficulty() != stratum.DefaultDifficulty {
 		t.Fatalf("mining.set_difficulty not received.")
 	}
-	if ctx.CurrentJob.JobId != "bf" {
+	if ctx.CurrentJob == nil {
 		t.Fatalf("mining.notify not received.")
 	}
 
@@ -180,10 +203,15 @@ func TestBadAuthorize(t *testing.T) {
 
 	ctx := client.Context()
 	err = client.Authorize("12HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
-	if ctx.Authorized != false {
-		t.Fatalf("mining authorize should fail")
+	if err != stratum.ErrAuthRejected || ctx.Authorized != false {
+		t.Fatalf("mining authorize should fail: %v", err)
 	}
 
+	// server closes after reply sent
+	select {
+	case <-errch:
+	case <-time.After(time.Second):
+	}
 	_, err = io.WriteString(cli, "FAKE")
 	if err == nil || err.Error() != "io: read/write on closed pipe" {
 		t.Fatalf("client should closed on authorization fail: %v", err)
@@ -211,7 +239,7 @@ func TestSubmit(t *testing.T) {
 	}
 
 	time.Sleep(20 * time.Millisecond) // wait for job
-	if ctx.Difficulty != stratum.DefaultDifficulty {
+	if ctx.Difficulty() != stratum.DefaultDifficulty {
 		t.Fatalf("mining.set_difficulty not received.")
 	}
 
@@ -250,12 +278,6 @@ func TestNewJob(t *testing.T) {
 		t.Fatalf("mining authorize failed")
 	}
 
-	time.Sleep(20 * time.Millisecond) // wait for job
-	if ctx.CurrentJob.JobId != "bf" {
-		t.Fatalf("mining.notify not received.")
-	}
-
-	prevJobId := ctx.CurrentJob.JobId
 	// push newjob
 	orderId := 1
 	pool, ok := stratum.FindPool(orderId)
@@ -264,6 +286,13 @@ func TestNewJob(t *testing.T) {
 	}
 	upstramCtx := pool.Context()
 
+	time.Sleep(20 * time.Millisecond) // wait for job
+	if ctx.CurrentJob.JobId != pool.CurrentJob.JobId {
+		t.Fatalf("mining.notify not received.")
+	}
+
+	prevJobId := ctx.CurrentJob.JobId
+
 	list := birpc.List{
 		"foo",
 		"4d16b6f85af6e2198f44ae2a6de67f78487ae5611b77c6c0440b921e00000000",
@@ -279,9 +308,12 @@ func TestNewJob(t *testing.T) {
 	upstramCtx.JobCh <- newJob
 
 	time.Sleep(20 * time.Millisecond) // wait for server push new job
-	if ctx.CurrentJob.JobId != "foo" {
+	if ctx.CurrentJob.JobId == prevJobId || ctx.CurrentJob.JobId != pool.CurrentJob.JobId {
 		t.Fatalf("mining.notify not received.")
 	}
+	if pool.CurrentJob.UpstreamJobId != "foo" {
+		t.Fatalf("upstream job id not kept: %s", pool.CurrentJob.UpstreamJobId)
+	}
 
 	if !newJob.MerkleBranch[0].IsEqual(ctx.CurrentJob.MerkleBranch[0]) {
 		t.Fatalf("mining.notify: job merkle branch not equal.")
@@ -301,3 +333,1762 @@ func TestNewJob(t *testing.T) {
 
 	closeServer()
 }
+
+func TestJobIdRemap(t *testing.T) {
+	initServer()
+	upstream := addOrder()
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	err := client.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+
+	ctx := client.Context()
+	err = client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	if !ctx.Authorized {
+		t.Fatalf("mining authorize failed")
+	}
+
+	time.Sleep(20 * time.Millisecond) // wait for job
+	if ctx.CurrentJob.JobId == upstream.JobId() {
+		t.Fatalf("worker received upstream job id.")
+	}
+
+	pool, _ := stratum.FindPool(1)
+	if pool.CurrentJob.UpstreamJobId != upstream.JobId() {
+		t.Fatalf("upstream job id not mapped: %s", pool.CurrentJob.UpstreamJobId)
+	}
+
+	// upstream job id is unknown to workers
+	err = client.Submit(ctx.Username, upstream.JobId(),
+		"0001", "504e86ed", "b2957c02")
+	err2, ok := err.(*birpc.Error)
+	if !ok || err2.Code != stratum.ErrorJobNotFound {
+		t.Fatalf("share with upstream job id got accepted: %v", err)
+	}
+
+	closeServer()
+}
+
+func TestJobIdCounter(t *testing.T) {
+	counter := stratum.NewJobIdCounter(1, 0)
+	if next := counter.Next(); next != "10000000000000000" {
+		t.Errorf("incorrect job id: %v", next)
+	}
+
+	other := stratum.NewJobIdCounter(1, 1)
+	if next := other.Next(); next != "10000000100000000" {
+		t.Errorf("incorrect job id for next generation: %v", next)
+	}
+
+	// ids of a generation 256 reconnects later never repeat
+	later := stratum.NewJobIdCounter(1, 256)
+	if next := later.Next(); next != "10000010000000000" {
+		t.Errorf("incorrect job id after 256 generations: %v", next)
+	}
+	for i := 0; i < 0x10000; i++ {
+		counter.Next()
+	}
+	if next := counter.Next(); next != "10000000000010001" {
+		t.Errorf("job id wrapped after 65536 jobs: %v", next)
+	}
+}
+
+func TestSubmitNtimeOutOfRange(t *testing.T) {
+	initServer()
+	addOrder()
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	err := client.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+
+	ctx := client.Context()
+	err = client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	if !ctx.Authorized {
+		t.Fatalf("mining authorize failed")
+	}
+
+	time.Sleep(20 * time.Millisecond) // wait for job
+
+	// job ntime is 504e86b9
+	err = client.Submit(ctx.Username, ctx.CurrentJob.JobId,
+		"0001", "504e86b8", "b2957c02")
+	err2, ok := err.(*birpc.Error)
+	if !ok || err2.Code != stratum.ErrorNtimeOutOfRange {
+		t.Fatalf("ntime behind job got accepted: %v", err)
+	}
+
+	err = client.Submit(ctx.Username, ctx.CurrentJob.JobId,
+		"0001", "504ea2da", "b2957c02")
+	err2, ok = err.(*birpc.Error)
+	if !ok || err2.Code != stratum.ErrorNtimeOutOfRange {
+		t.Fatalf("ntime too far ahead of job got accepted: %v", err)
+	}
+
+	closeServer()
+}
+
+func TestVersionRolling(t *testing.T) {
+	initServer()
+	upstream := addOrder()
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	err := client.Configure(0x00ffff00)
+	if err != nil {
+		t.Fatalf("Failed on configure: %v", err)
+	}
+	ctx := client.Context()
+	if ctx.VersionMask != 0x00ffe000 {
+		t.Fatalf("version mask not intersected: %08x", ctx.VersionMask)
+	}
+
+	err = client.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+
+	err = client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	if !ctx.Authorized {
+		t.Fatalf("mining authorize failed")
+	}
+
+	time.Sleep(20 * time.Millisecond) // wait for job
+
+	err = client.Submit(ctx.Username, ctx.CurrentJob.JobId,
+		"0001", "504e86ed", "b2957c02", "00000100")
+	err2, ok := err.(*birpc.Error)
+	if !ok || err2.Msg != "invalid version bits" {
+		t.Fatalf("version bits out of mask got accepted: %v", err)
+	}
+
+	// rolled version changes header hash, share no longer meets target
+	err = client.Submit(ctx.Username, ctx.CurrentJob.JobId,
+		"0001", "504e86ed", "b2957c02", "00002000")
+	err2, ok = err.(*birpc.Error)
+	if !ok || err2.Code != stratum.ErrorLowDifficultyShare {
+		t.Fatalf("version bits not applied: %v", err)
+	}
+
+	// mask of worker still a subset, not sent again
+	upstream.SetVersionMask(0x0fffe000)
+	time.Sleep(20 * time.Millisecond)
+	if ctx.VersionMask != 0x00ffe000 {
+		t.Fatalf("version mask changed: %08x", ctx.VersionMask)
+	}
+
+	// upstream narrows mask, worker narrowed too
+	upstream.SetVersionMask(0x000fe000)
+	time.Sleep(20 * time.Millisecond)
+	if ctx.VersionMask != 0x000fe000 {
+		t.Fatalf("version mask not narrowed: %08x", ctx.VersionMask)
+	}
+	err = client.Submit(ctx.Username, ctx.CurrentJob.JobId,
+		"0001", "504e86ed", "b2957c02", "00800000")
+	err2, ok = err.(*birpc.Error)
+	if !ok || err2.Msg != "invalid version bits" {
+		t.Fatalf("version bits out of narrowed mask got accepted: %v", err)
+	}
+
+	closeServer()
+}
+
+func TestBlockCandidate(t *testing.T) {
+	initServer()
+	upstream := addOrder()
+
+	found := make(chan *stratum.BlockCandidate, 1)
+	server.OnBlockCandidate(func(block *stratum.BlockCandidate) {
+		found <- block
+	})
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	// worker target over network target, blocks still go upstream
+	if err := client.SuggestDifficulty(64); err != nil {
+		t.Fatalf("Failed on suggest difficulty: %v", err)
+	}
+	err := client.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+
+	ctx := client.Context()
+	err = client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	if !ctx.Authorized {
+		t.Fatalf("mining authorize failed")
+	}
+
+	time.Sleep(20 * time.Millisecond) // wait for job
+
+	// solved testnet3 block 000000002076870fe65a2b6eeed84fa892c0db924f1482243a6247d931dcab32
+	err = client.Submit(ctx.Username, ctx.CurrentJob.JobId,
+		"0001", "504e86ed", "b2957c02")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	select {
+	case block := <-found:
+		if block.Hash != "000000002076870fe65a2b6eeed84fa892c0db924f1482243a6247d931dcab32" {
+			t.Fatalf("unexpected block candidate: %s", block.Hash)
+		}
+		if block.UpstreamJobId != upstream.JobId() || len(block.Header) != 160 {
+			t.Fatalf("incomplete block candidate: %v", block)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("block candidate not notified.")
+	}
+
+	if len(server.BlockCandidates()) != 1 {
+		t.Fatalf("block candidate not recorded.")
+	}
+	for i := 0; i < 50 && len(upstream.Shares()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if len(upstream.Shares()) != 1 {
+		t.Fatalf("block candidate not submitted upstream.")
+	}
+
+	closeServer()
+}
+
+func TestSuggestDifficulty(t *testing.T) {
+	initServer()
+	addOrder()
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	err := client.SuggestDifficulty(64)
+	if err != nil {
+		t.Fatalf("Failed on suggest difficulty: %v", err)
+	}
+
+	err = client.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond) // wait for notification
+	ctx := client.Context()
+	if ctx.Difficulty() != 64 {
+		t.Fatalf("suggested difficulty not used: %v", ctx.Difficulty())
+	}
+
+	// difficulty hint in worker name
+	err = client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1.rig1.d=512", "x")
+	if !ctx.Authorized {
+		t.Fatalf("mining authorize failed: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond) // wait for notification
+	if ctx.Difficulty() != 512 {
+		t.Fatalf("difficulty hint in worker name not used: %v", ctx.Difficulty())
+	}
+
+	closeServer()
+}
+
+func TestClientMethods(t *testing.T) {
+	initServer()
+	addOrder()
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	err := client.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond) // wait for client.get_version
+	workers := server.Workers()
+	if len(workers) != 1 || workers[0].MinerVersion() != stratum.Version {
+		t.Fatalf("client.get_version not recorded.")
+	}
+
+	recorder := httptest.NewRecorder()
+	server.WorkersNotifyHandler(recorder, httptest.NewRequest("POST",
+		"/api/workers/notify?action=message&message=maintenance+in+5+minutes", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Message expected %d, got %d", http.StatusOK, recorder.Code)
+	}
+	time.Sleep(20 * time.Millisecond) // wait for notification
+	if client.Context().Message != "maintenance in 5 minutes" {
+		t.Fatalf("client.show_message not received.")
+	}
+
+	// miner disconnects itself on client.reconnect
+	recorder = httptest.NewRecorder()
+	server.WorkersNotifyHandler(recorder, httptest.NewRequest("POST",
+		"/api/workers/notify?action=redirect&port=3336", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Redirect expected %d, got %d", http.StatusOK, recorder.Code)
+	}
+	for i := 0; i < 50 && len(server.Workers()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(server.Workers()) != 0 {
+		t.Fatalf("Worker should be redirected.")
+	}
+
+	closeServer()
+}
+
+func TestListenerAlgorithm(t *testing.T) {
+	initServer()
+	addAlgorithmOrder("scrypt")
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	// default listener serves sha256 only
+	err := client.Subscribe()
+	if err == nil || err.Error() != "No pool available" {
+		t.Fatalf("scrypt order should not be eligible on sha256 listener: %v", err)
+	}
+
+	closeServer()
+}
+
+func TestListenerDifficulty(t *testing.T) {
+	cli, srv = net.Pipe()
+	listener, _ := stratum.ParseListener("sha256@:3335/512/256/1024")
+	options := stratum.Options{
+		SubscribeTimeout: time.Duration(100) * time.Millisecond,
+		Listeners:        []stratum.ListenerOptions{listener},
+	}
+	server = stratum.NewStratumServer(options)
+	go server.ServeConn(srv)
+	addAlgorithmOrder("sha256")
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+	if err := client.Subscribe(); err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if diff := client.Context().Difficulty(); diff != 512 {
+		t.Fatalf("Listener starting difficulty expected, got %v", diff)
+	}
+
+	closeServer()
+}
+
+func TestReloadBans(t *testing.T) {
+	initServer()
+	addOrder()
+
+	config := &stratum.Config{
+		Bans:    []string{"1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1"},
+		Vardiff: &stratum.VardiffConfig{Variance: 150},
+	}
+	if err := server.Reload(config); err == nil {
+		t.Fatalf("Invalid config should not be reloaded.")
+	}
+	config.Vardiff = nil
+	if err := server.Reload(config); err != nil {
+		t.Fatalf("Failed to reload config: %s", err)
+	}
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	err := client.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+
+	ctx := client.Context()
+	client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	if ctx.Authorized {
+		t.Fatalf("Banned address should not be authorized.")
+	}
+
+	closeServer()
+}
+
+func TestReloadVardiff(t *testing.T) {
+	cli, srv = net.Pipe()
+	lo := stratum.DefaultListenerOptions()
+	lo.MaxDifficulty = 0
+	server = stratum.NewStratumServer(stratum.Options{
+		SubscribeTimeout: time.Duration(100) * time.Millisecond,
+		Listeners:        []stratum.ListenerOptions{lo},
+	})
+	go server.ServeConn(srv)
+	addOrder()
+
+	// listener inherits vardiff of server, never retargets in test
+	config := &stratum.Config{
+		Vardiff: &stratum.VardiffConfig{TargetTime: stratum.Duration(time.Hour), RetargetTime: stratum.Duration(time.Hour)},
+	}
+	if err := server.Reload(config); err != nil {
+		t.Fatalf("Failed to reload config: %s", err)
+	}
+	// retargets on first share once reloaded
+	config.Vardiff.RetargetTime = 0
+	if err := server.Reload(config); err != nil {
+		t.Fatalf("Failed to reload config: %s", err)
+	}
+
+	client := subscribeWorker(t, cli)
+	ctx := client.Context()
+	if err := client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02"); err != nil {
+		t.Fatalf("Share rejected: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond) // wait for notification
+	if ctx.Difficulty() != stratum.DefaultDifficulty*stratum.MaxRetargetRatio {
+		t.Fatalf("Listener should follow reloaded vardiff, difficulty %v", ctx.Difficulty())
+	}
+
+	closeServer()
+}
+
+func TestZeroFees(t *testing.T) {
+	cli, srv = net.Pipe()
+	server = stratum.NewStratumServer(stratum.Options{
+		SubscribeTimeout: time.Duration(100) * time.Millisecond,
+		Fees:             &stratum.FeeSchedule{},
+	})
+	go server.ServeConn(srv)
+	addOrder()
+
+	// reload without fees keeps the schedule
+	if err := server.Reload(&stratum.Config{}); err != nil {
+		t.Fatalf("Failed to reload config: %s", err)
+	}
+	var orders []stratum.OrderStats
+	getJson(t, server.OrdersHandler, &orders)
+	if len(orders) != 1 || orders[0].FeeRate != 0 {
+		t.Fatalf("Zero fees should be kept: %+v", orders)
+	}
+
+	closeServer()
+}
+
+type countFlusher struct {
+	flushed int
+}
+
+func (f *countFlusher) Flush() error {
+	f.flushed += 1
+	return nil
+}
+
+func TestDrain(t *testing.T) {
+	initServer()
+	addOrder()
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	err := client.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+	ctx := client.Context()
+	client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	time.Sleep(20 * time.Millisecond) // wait for job
+
+	// upstream of mock order never reads, submit blocks until drain timeout
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+
+	flusher := &countFlusher{}
+	server.AddFlusher(flusher)
+
+	start := time.Now()
+	server.Drain(300 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Drain should finish by timeout: %v", elapsed)
+	}
+	if flusher.flushed != 1 {
+		t.Fatalf("Store not flushed on drain.")
+	}
+
+	_, err = io.WriteString(cli, "FAKE")
+	if err == nil {
+		t.Fatalf("Worker should be closed after drain.")
+	}
+
+	cli.Close()
+	srv.Close()
+}
+
+func TestDrainUpstreamLost(t *testing.T) {
+	initServer()
+	addFakeOrder(&stratum.Order{
+		Id:       1,
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	}, stratumtest.Options{
+		Submit: func(share *stratumtest.Share) error { return stratumtest.ErrDisconnect },
+	})
+
+	client := subscribeWorker(t, cli)
+	ctx := client.Context()
+	client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	time.Sleep(20 * time.Millisecond) // wait for job
+
+	// upstream drops on submit, pending submit fails instead of blocking drain
+	go client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	server.Drain(5 * time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Drain should not wait submit to lost upstream: %v", elapsed)
+	}
+
+	cli.Close()
+	srv.Close()
+}
+
+func TestMetrics(t *testing.T) {
+	initServer()
+	upstream := addOrder()
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	err := client.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+	ctx := client.Context()
+	client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	time.Sleep(20 * time.Millisecond) // wait for job
+
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+	client.Submit(ctx.Username, "deadbeef", "0001", "504e86ed", "b2957c02")
+
+	recorder := httptest.NewRecorder()
+	server.MetricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	for _, line := range []string{
+		"ninepool_workers_connected 1",
+		`ninepool_shares_total{order="1",result="accepted"} 1`,
+		`ninepool_shares_total{order="1",result="rejected",reason="duplicate_share"} 1`,
+		`ninepool_shares_total{order="1",result="stale",reason="job_not_found"} 1`,
+		`ninepool_pool_up{order="1",pool="` + upstream.Addr() + `"} 1`,
+		`ninepool_pool_workers{order="1",pool="` + upstream.Addr() + `"} 1`,
+		`ninepool_job_broadcast_seconds_count{order="1"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("Metric %s not found in:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `ninepool_pool_hashrate{order="1",pool="`+upstream.Addr()+`"} 0`+"\n") {
+		t.Fatalf("Pool hashrate should count accepted share.")
+	}
+
+	closeServer()
+}
+
+func TestStatsApi(t *testing.T) {
+	initServer()
+	addOrder()
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+
+	err := client.Subscribe()
+	if err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+	ctx := client.Context()
+	client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	time.Sleep(20 * time.Millisecond) // wait for job
+
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+
+	var workers []stratum.WorkerStats
+	getJson(t, server.WorkersHandler, &workers)
+	if len(workers) != 1 {
+		t.Fatalf("Expected 1 worker, got %d", len(workers))
+	}
+	worker := workers[0]
+	if worker.Name != ctx.Username || worker.Accepted != 1 || worker.Rejected != 1 ||
+		worker.LastShare == nil || worker.Hashrate.M5 <= 0 || worker.Hashrate.H1 <= 0 ||
+		worker.Pool != 1 || worker.MinerVersion != stratum.Version || worker.RemoteAddr != "pipe" {
+		t.Fatalf("Unexpected worker stats: %+v", worker)
+	}
+
+	var pools []stratum.PoolStats
+	getJson(t, server.PoolsHandler, &pools)
+	if len(pools) != 1 || pools[0].Workers != 1 || pools[0].CurrentJob != ctx.CurrentJob.JobId ||
+		pools[0].State != "working" || !pools[0].Available {
+		t.Fatalf("Unexpected pool stats: %+v", pools)
+	}
+
+	var orders []stratum.OrderStats
+	getJson(t, server.OrdersHandler, &orders)
+	if len(orders) != 1 || orders[0].Hashrate.M5 <= 0 || pools[0].Hashrate.M5 <= 0 ||
+		orders[0].FeeRate != stratum.DefaultFeeRate {
+		t.Fatalf("Unexpected order stats: %+v", orders)
+	}
+
+	names := server.NameHashrates()
+	if names[ctx.Username].M5 <= 0 {
+		t.Fatalf("Unexpected worker name hashrate: %+v", names)
+	}
+
+	closeServer()
+}
+
+func TestNameHashrates(t *testing.T) {
+	initServer()
+	addOrder()
+
+	client := stratum.NewClient(cli, make(chan error))
+	if err := client.Subscribe(); err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+	client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1.rig1.d=1", "x")
+	time.Sleep(20 * time.Millisecond) // wait for job
+	ctx := client.Context()
+	if err := client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02"); err != nil {
+		t.Fatalf("Share rejected: %v", err)
+	}
+
+	// keyed on address and worker, difficulty hint taken out
+	names := server.NameHashrates()
+	if len(names) != 1 || names["1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1.rig1"].M5 <= 0 {
+		t.Fatalf("Unexpected worker name hashrate: %+v", names)
+	}
+
+	window := stratum.LongHashrateWindow
+	stratum.LongHashrateWindow = time.Millisecond
+	defer func() { stratum.LongHashrateWindow = window }()
+	time.Sleep(5 * time.Millisecond)
+	if names := server.NameHashrates(); len(names) != 0 {
+		t.Fatalf("Stale worker name should be dropped: %+v", names)
+	}
+
+	closeServer()
+}
+
+func getJson(t *testing.T, handler http.HandlerFunc, v interface{}) {
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/", nil))
+	if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+		t.Fatalf("Invalid json: %s, %s", err, recorder.Body.String())
+	}
+}
+
+func TestShareLogApi(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ninepool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cli, srv = net.Pipe()
+	server = stratum.NewStratumServer(stratum.Options{
+		SubscribeTimeout: time.Duration(100) * time.Millisecond,
+		DataDir:          dir,
+	})
+	go server.ServeConn(srv)
+	// upstream holds submits until test done
+	hold := make(chan struct{})
+	defer close(hold)
+	upstream := addFakeOrder(&stratum.Order{
+		Id:       1,
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	}, stratumtest.Options{
+		VersionMask: 0x1fffe000,
+		Submit: func(share *stratumtest.Share) error {
+			<-hold
+			return nil
+		},
+	})
+
+	errch := make(chan error)
+	client := stratum.NewClient(cli, errch)
+	if err := client.Subscribe(); err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+	ctx := client.Context()
+	client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	time.Sleep(20 * time.Millisecond) // wait for job
+
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+
+	query := func(url string) []stratum.ShareRecord {
+		recorder := httptest.NewRecorder()
+		server.SharesHandler(recorder, httptest.NewRequest("GET", url, nil))
+		var records []stratum.ShareRecord
+		if err := json.Unmarshal(recorder.Body.Bytes(), &records); err != nil {
+			t.Fatalf("Invalid json: %s, %s", err, recorder.Body.String())
+		}
+		return records
+	}
+
+	records := query("/api/shares?order=1&worker=" + ctx.Username)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 shares logged, got %+v", records)
+	}
+	if records[0].Result != "accepted" || records[0].Upstream != stratum.UpstreamPending ||
+		records[0].Hash == "" || records[0].JobId != ctx.CurrentJob.JobId || records[0].UpstreamJobId != upstream.JobId() {
+		t.Fatalf("Unexpected accepted share: %+v", records[0])
+	}
+	if records[1].Result != "rejected" || records[1].Reason != "duplicate_share" || records[1].Upstream != "" {
+		t.Fatalf("Unexpected rejected share: %+v", records[1])
+	}
+	if records := query("/api/shares?result=stale"); len(records) != 0 {
+		t.Fatalf("Unexpected stale shares: %+v", records)
+	}
+
+	var accounts []stratum.Account
+	getJson(t, server.BalancesHandler, &accounts)
+	if len(accounts) != 0 {
+		t.Fatalf("Seller credited before upstream accepted share: %+v", accounts)
+	}
+	hold <- struct{}{}
+	for i := 0; i < 100 && len(accounts) == 0; i++ {
+		time.Sleep(time.Millisecond)
+		getJson(t, server.BalancesHandler, &accounts)
+	}
+	if len(accounts) != 1 || accounts[0].Address != ctx.Username || accounts[0].Shares != 1 {
+		t.Fatalf("Seller not credited for accepted share: %+v", accounts)
+	}
+
+	recorder := httptest.NewRecorder()
+	server.SharesHandler(recorder, httptest.NewRequest("GET", "/api/shares?since=yesterday", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("Invalid since should be rejected, got %d", recorder.Code)
+	}
+
+	closeServer()
+}
+
+func TestPayoutsApi(t *testing.T) {
+	initServer()
+	ledger := server.Ledger()
+	order := &stratum.Order{Id: 1}
+	ledger.Credit(order, "1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", 2e8)
+	ledger.Credit(order, "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda", 100)
+
+	recorder := httptest.NewRecorder()
+	server.PayoutsHandler(recorder, httptest.NewRequest("POST", "/api/payouts?format=csv", nil))
+	expected := "address,amount\n1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1,199600000\n"
+	if recorder.Code != http.StatusOK || recorder.Body.String() != expected {
+		t.Fatalf("Unexpected payout csv: %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	server.PayoutsHandler(recorder, httptest.NewRequest("POST", "/api/payouts", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("No balance due expected, got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	server.PayoutsHandler(recorder, httptest.NewRequest("GET", "/api/payouts?id=1", nil))
+	var payout stratum.Payout
+	if err := json.Unmarshal(recorder.Body.Bytes(), &payout); err != nil {
+		t.Fatalf("Invalid json: %s", err)
+	}
+	if payout.Id != 1 || payout.Total != 199600000 || len(payout.Items) != 1 {
+		t.Fatalf("Unexpected payout: %+v", payout)
+	}
+
+	closeServer()
+}
+
+func subscribeWorker(t *testing.T, conn net.Conn) *stratum.StratumClient {
+	client := stratum.NewClient(conn, make(chan error))
+	if err := client.Subscribe(); err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+	client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+	time.Sleep(20 * time.Millisecond) // wait for job
+	return client
+}
+
+func TestReservation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ninepool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cli, srv = net.Pipe()
+	server = stratum.NewStratumServer(stratum.Options{
+		SubscribeTimeout: time.Duration(100) * time.Millisecond,
+		DataDir:          dir,
+	})
+	go server.ServeConn(srv)
+	for id, price := range map[uint64]uint64{1: 100, 2: 50} {
+		addMockOrder(&stratum.Order{
+			Id:       id,
+			Price:    price,
+			Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+			Password: "x",
+		})
+	}
+
+	// worker bound to order of highest price without reservation
+	client := subscribeWorker(t, cli)
+	ctx := client.Context()
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+	var workers []stratum.WorkerStats
+	getJson(t, server.WorkersHandler, &workers)
+	if len(workers) != 1 || workers[0].Pool != 1 {
+		t.Fatalf("Worker should bind to order #1: %+v", workers)
+	}
+
+	capacity := server.Capacity("sha256")
+	if capacity <= 0 {
+		t.Fatalf("No capacity from worker hashrate.")
+	}
+	start := time.Now().Add(-time.Minute)
+	end := time.Now().Add(time.Hour)
+	if err := server.Reserve(&stratum.Reservation{Order: 2, Hashrate: capacity * 2, Start: start, End: end}); err != stratum.ErrReservationCapacity {
+		t.Fatalf("Reservation over capacity accepted: %v", err)
+	}
+	if err := server.Reserve(&stratum.Reservation{Order: 2, Hashrate: capacity * 0.4, Start: start, End: end}); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+	if err := server.Reserve(&stratum.Reservation{Order: 1, Hashrate: capacity * 0.7, Start: start, End: end}); err != stratum.ErrReservationCapacity {
+		t.Fatalf("Overlapping reservations over capacity accepted: %v", err)
+	}
+	if err := server.Reserve(&stratum.Reservation{Order: 1, Hashrate: capacity * 0.7, Start: end, End: end.Add(time.Hour)}); err != nil {
+		t.Fatalf("Failed to reserve later window: %v", err)
+	}
+
+	// new worker bound to order with reservation not met
+	cli2, srv2 := net.Pipe()
+	go server.ServeConn(srv2)
+	subscribeWorker(t, cli2)
+	getJson(t, server.WorkersHandler, &workers)
+	bound := map[uint64]int{}
+	for _, worker := range workers {
+		bound[worker.Pool] += 1
+	}
+	if bound[1] != 1 || bound[2] != 1 {
+		t.Fatalf("Worker should bind to reserved order #2: %+v", workers)
+	}
+
+	var orders []stratum.OrderStats
+	getJson(t, server.OrdersHandler, &orders)
+	for _, order := range orders {
+		if order.Id == 2 && (order.Reserved != capacity*0.4 || len(order.Reservations) != 1) {
+			t.Fatalf("Unexpected reservation of order #2: %+v", order)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	body := strings.NewReader(`{"Order": 3, "Hashrate": 1, "Start": "2014-06-01T00:00:00Z", "End": "2099-06-01T00:00:00Z"}`)
+	server.ReservationsHandler(recorder, httptest.NewRequest("POST", "/api/reservations", body))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("Reservation of unknown order should fail, got %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	server.ReservationsHandler(recorder, httptest.NewRequest("DELETE", "/api/reservations?id=2", nil))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Failed to cancel reservation: %d", recorder.Code)
+	}
+
+	reservations, err := stratum.LoadReservations(filepath.Join(dir, stratum.ReservationsName))
+	if err != nil {
+		t.Fatalf("Failed to load reservations: %s", err)
+	}
+	if list := reservations.List(0, time.Now()); len(list) != 1 || list[0].Order != 2 {
+		t.Fatalf("Reservations not persisted: %+v", list)
+	}
+
+	cli2.Close()
+	srv2.Close()
+	closeServer()
+}
+
+func TestVipPriority(t *testing.T) {
+	initServer()
+	for id, vip := range map[uint64]bool{1: false, 2: true} {
+		addMockOrder(&stratum.Order{
+			Id:       id,
+			Price:    100,
+			Vip:      vip,
+			Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+			Password: "x",
+		})
+	}
+
+	// VIP order wins at equal price
+	client := subscribeWorker(t, cli)
+	ctx := client.Context()
+	var workers []stratum.WorkerStats
+	getJson(t, server.WorkersHandler, &workers)
+	if len(workers) != 1 || workers[0].Pool != 2 {
+		t.Fatalf("Worker should bind to VIP order #2: %+v", workers)
+	}
+
+	// all hashrate delivered to VIP order, over default cap of 30%
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+	cli2, srv2 := net.Pipe()
+	go server.ServeConn(srv2)
+	subscribeWorker(t, cli2)
+	getJson(t, server.WorkersHandler, &workers)
+	bound := map[uint64]int{}
+	for _, worker := range workers {
+		bound[worker.Pool] += 1
+	}
+	if bound[1] != 1 || bound[2] != 1 {
+		t.Fatalf("VIP order over cap should lose priority: %+v", workers)
+	}
+
+	cli2.Close()
+	srv2.Close()
+	closeServer()
+}
+
+func TestVipCap(t *testing.T) {
+	initServer()
+	for id, vip := range map[uint64]bool{1: false, 2: true} {
+		addMockOrder(&stratum.Order{
+			Id:       id,
+			Price:    100 * id,
+			Vip:      vip,
+			Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+			Password: "x",
+		})
+	}
+
+	client := subscribeWorker(t, cli)
+	ctx := client.Context()
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+
+	// VIP order over cap gets no workers while another order is eligible,
+	// even at higher price
+	cli2, srv2 := net.Pipe()
+	go server.ServeConn(srv2)
+	subscribeWorker(t, cli2)
+	var workers []stratum.WorkerStats
+	getJson(t, server.WorkersHandler, &workers)
+	bound := map[uint64]int{}
+	for _, worker := range workers {
+		bound[worker.Pool] += 1
+	}
+	if bound[1] != 1 || bound[2] != 1 {
+		t.Fatalf("VIP order over cap should get no workers: %+v", workers)
+	}
+
+	cli2.Close()
+	srv2.Close()
+	closeServer()
+}
+
+func TestVipCapOnlyVip(t *testing.T) {
+	initServer()
+	addMockOrder(&stratum.Order{
+		Id:       1,
+		Price:    100,
+		Vip:      true,
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	})
+
+	client := subscribeWorker(t, cli)
+	ctx := client.Context()
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+
+	// VIP order over cap is the last pool eligible, still gets workers
+	cli2, srv2 := net.Pipe()
+	go server.ServeConn(srv2)
+	subscribeWorker(t, cli2)
+	var workers []stratum.WorkerStats
+	getJson(t, server.WorkersHandler, &workers)
+	if len(workers) != 2 || workers[0].Pool != 1 || workers[1].Pool != 1 {
+		t.Fatalf("Workers should bind to only VIP order: %+v", workers)
+	}
+
+	cli2.Close()
+	srv2.Close()
+	closeServer()
+}
+
+func TestReservationRebalance(t *testing.T) {
+	initServer()
+	for id, price := range map[uint64]uint64{1: 100, 2: 50} {
+		addMockOrder(&stratum.Order{
+			Id:       id,
+			Price:    price,
+			Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+			Password: "x",
+		})
+	}
+	client := subscribeWorker(t, cli)
+	ctx := client.Context()
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", "b2957c02")
+
+	created := time.Now()
+	reservation := &stratum.Reservation{
+		Order:    2,
+		Hashrate: server.Capacity("sha256") * 0.4,
+		Start:    created.Add(-time.Minute),
+		End:      created.Add(time.Hour),
+	}
+	if err := server.Reserve(reservation); err != nil {
+		t.Fatalf("Failed to reserve: %v", err)
+	}
+
+	// reservation active before, workers stay
+	server.Rebalance(time.Now(), time.Now())
+	time.Sleep(20 * time.Millisecond)
+	if state := orderState(t, 1); state != "working" {
+		t.Fatalf("Worker should stay on order #1, got %s", state)
+	}
+
+	server.Rebalance(created.Add(-time.Second), time.Now())
+	for i := 0; i < 100 && orderState(t, 1) != "connected"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := orderState(t, 1); state != "connected" {
+		t.Fatalf("Worker should be released to reserved order, got %s", state)
+	}
+
+	closeServer()
+}
+
+func TestAutoBid(t *testing.T) {
+	initServer()
+	addMockOrder(&stratum.Order{
+		Id:       1,
+		Price:    100,
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	})
+	bidder := &stratum.Order{
+		Id:             2,
+		Price:          50,
+		MaxPrice:       80,
+		PriceStep:      20,
+		TargetHashrate: 1e12,
+		Username:       "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password:       "x",
+	}
+	addMockOrder(bidder)
+
+	now := time.Now()
+	server.AutoBid(now)
+	server.AutoBid(now.Add(stratum.DefaultAutoBidPeriod))
+	if bidder.Price != 50 {
+		t.Fatalf("Price raised without workers taken by higher bid: %d", bidder.Price)
+	}
+
+	// worker taken by order #1 of higher price
+	subscribeWorker(t, cli)
+	for i, expected := range []uint64{50, 70, 80, 80} {
+		server.AutoBid(now.Add(time.Duration(i) * stratum.DefaultAutoBidPeriod))
+		if bidder.Price != expected {
+			t.Fatalf("Round %d expected price %d, got %d", i, expected, bidder.Price)
+		}
+	}
+	if state := orderState(t, 1); state != "working" {
+		t.Fatalf("Worker should stay with higher bid, got %s", state)
+	}
+
+	// paused order never bids
+	bidder.MaxPrice = 120
+	bidder.PriceStep = 30
+	if err := server.PauseOrder(2); err != nil {
+		t.Fatalf("Failed to pause order: %v", err)
+	}
+	server.AutoBid(now.Add(4 * stratum.DefaultAutoBidPeriod))
+	server.AutoBid(now.Add(5 * stratum.DefaultAutoBidPeriod))
+	if bidder.Price != 80 {
+		t.Fatalf("Price of paused order raised: %d", bidder.Price)
+	}
+	if err := server.ResumeOrder(2); err != nil {
+		t.Fatalf("Failed to resume order: %v", err)
+	}
+
+	// outbids order #1, its worker asked to reconnect
+	bidder.MaxPrice = 120
+	bidder.PriceStep = 30
+	server.AutoBid(now.Add(4 * stratum.DefaultAutoBidPeriod))
+	server.AutoBid(now.Add(5 * stratum.DefaultAutoBidPeriod))
+	if bidder.Price != 110 {
+		t.Fatalf("Expected price 110, got %d", bidder.Price)
+	}
+	for i := 0; i < 100 && orderState(t, 1) != "connected"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := orderState(t, 1); state != "connected" {
+		t.Fatalf("Worker should be released by lower bid, got %s", state)
+	}
+
+	closeServer()
+}
+
+func TestAutoBidReleasesMissing(t *testing.T) {
+	initServer()
+	addFakeOrder(&stratum.Order{
+		Id:       1,
+		Price:    100,
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	}, stratumtest.Options{Difficulty: stratum.DefaultMinDifficulty})
+	cli2, srv2 := net.Pipe()
+	defer cli2.Close()
+	for _, conn := range []net.Conn{cli, cli2} {
+		if conn == cli2 {
+			// served once first worker mined, within subscribe timeout
+			go server.ServeConn(srv2)
+		}
+		client := stratum.NewClient(conn, make(chan error))
+		// shares easy enough to mine
+		client.SuggestDifficulty(stratum.DefaultMinDifficulty)
+		if err := client.Subscribe(); err != nil {
+			t.Fatalf("Failed on subscribe: %v", err)
+		}
+		client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x")
+		time.Sleep(20 * time.Millisecond) // wait for job
+		ctx := client.Context()
+		if err := client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", ctx.CurrentJob.Ntime, mineShare(ctx, "0001")); err != nil {
+			t.Fatalf("Share rejected: %v", err)
+		}
+	}
+
+	// target met by any one of two workers of order #1
+	var workers []stratum.WorkerStats
+	getJson(t, server.WorkersHandler, &workers)
+	target := math.Min(workers[0].Hashrate.EMA, workers[1].Hashrate.EMA) / 10
+	bidder := &stratum.Order{
+		Id:             2,
+		Price:          90,
+		MaxPrice:       120,
+		PriceStep:      30,
+		TargetHashrate: target,
+		Username:       "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password:       "x",
+	}
+	addMockOrder(bidder)
+	now := time.Now()
+	server.AutoBid(now)
+	server.AutoBid(now.Add(stratum.DefaultAutoBidPeriod))
+	if bidder.Price != 120 {
+		t.Fatalf("Expected price 120, got %d", bidder.Price)
+	}
+
+	for i := 0; i < 100; i++ {
+		getJson(t, server.WorkersHandler, &workers)
+		if len(workers) < 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	getJson(t, server.WorkersHandler, &workers)
+	if len(workers) != 1 || workers[0].Pool != 1 {
+		t.Fatalf("Only hashrate missing should be released: %+v", workers)
+	}
+
+	closeServer()
+}
+
+func orderState(t *testing.T, id uint64) string {
+	var orders []stratum.OrderStats
+	getJson(t, server.OrdersHandler, &orders)
+	for _, order := range orders {
+		if order.Id == id {
+			return order.State
+		}
+	}
+	t.Fatalf("Order #%d not found.", id)
+	return ""
+}
+
+func TestAdminApi(t *testing.T) {
+	cli, srv = net.Pipe()
+	server = stratum.NewStratumServer(stratum.Options{AdminToken: "secret"})
+	handler := server.Handler()
+
+	cases := []struct {
+		method, token string
+		expected      int
+	}{
+		{"GET", "", http.StatusOK},
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "wrong", http.StatusUnauthorized},
+		{"POST", "secret", http.StatusBadRequest}, // passed to handler
+	}
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest(c.method, "/api/reservations", strings.NewReader("{"))
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		handler.ServeHTTP(recorder, r)
+		if recorder.Code != c.expected {
+			t.Fatalf("%s with token %q expected %d, got %d", c.method, c.token, c.expected, recorder.Code)
+		}
+	}
+	closeServer()
+
+	// state never changes over http without admin token configured
+	initServer()
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/orders/state?id=1&action=pause", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	server.Handler().ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("Admin API should be disabled, got %d", recorder.Code)
+	}
+	closeServer()
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	initServer()
+	for id, price := range map[uint64]uint64{1: 100, 2: 50} {
+		addMockOrder(&stratum.Order{
+			Id:       id,
+			Price:    price,
+			Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+			Password: "x",
+		})
+	}
+
+	subscribeWorker(t, cli)
+	if state := orderState(t, 1); state != "working" {
+		t.Fatalf("Order with worker should be working, got %s", state)
+	}
+	if state := orderState(t, 2); state != "connected" {
+		t.Fatalf("Order without worker should be connected, got %s", state)
+	}
+
+	// paused order takes no workers
+	if err := server.PauseOrder(1); err != nil {
+		t.Fatalf("Failed to pause: %s", err)
+	}
+	cli2, srv2 := net.Pipe()
+	go server.ServeConn(srv2)
+	subscribeWorker(t, cli2)
+	var workers []stratum.WorkerStats
+	getJson(t, server.WorkersHandler, &workers)
+	bound := map[uint64]int{}
+	for _, worker := range workers {
+		bound[worker.Pool] += 1
+	}
+	if bound[2] != 1 || orderState(t, 2) != "working" {
+		t.Fatalf("Worker should bind to order #2 while #1 paused: %+v", workers)
+	}
+
+	if err := server.ResumeOrder(2); err == nil {
+		t.Fatalf("Order not paused resumed.")
+	}
+	if err := server.ResumeOrder(1); err != nil {
+		t.Fatalf("Failed to resume: %s", err)
+	}
+	if err := server.UnbanOrder(1); err == nil {
+		t.Fatalf("Order not banned unbanned.")
+	}
+
+	if err := server.BanOrder(2, "test"); err != nil {
+		t.Fatalf("Failed to ban: %s", err)
+	}
+	var pools []stratum.PoolStats
+	getJson(t, server.PoolsHandler, &pools)
+	if len(pools) != 1 || pools[0].Id != 1 || orderState(t, 2) != "banned" {
+		t.Fatalf("Pool of banned order should stop: %+v", pools)
+	}
+
+	for _, expected := range []int{http.StatusOK, http.StatusConflict} {
+		recorder := httptest.NewRecorder()
+		server.OrderStateHandler(recorder, httptest.NewRequest("POST", "/api/orders/state?id=2&action=cancel", nil))
+		if recorder.Code != expected {
+			t.Fatalf("Cancel expected %d, got %d", expected, recorder.Code)
+		}
+	}
+	if state := orderState(t, 2); state != "closed_cancel" {
+		t.Fatalf("Order should be cancelled, got %s", state)
+	}
+
+	cli2.Close()
+	srv2.Close()
+	closeServer()
+}
+
+// mineShare returns nonce of a share on extranonce2 meeting difficulty of
+// client, hashed on current job.
+func mineShare(ctx *stratum.ClientContext, extraNonce2 string) string {
+	job := ctx.CurrentJob
+	merkleRoot := job.MerkleRoot(ctx.ExtraNonce1, extraNonce2)
+	header, err := stratum.SerializeHeader(job, merkleRoot, job.Ntime, "00000000")
+	if err != nil {
+		panic(err)
+	}
+	target := stratum.SHA256.Target(ctx.Difficulty())
+	for nonce := uint32(0); ; nonce++ {
+		header.Nonce = nonce
+		hash, _ := stratum.SHA256.HashHeader(header)
+		if stratum.ShaHashToBig(hash).Cmp(target) <= 0 {
+			return fmt.Sprintf("%08x", nonce)
+		}
+	}
+}
+
+func TestBanOnUpstreamRejects(t *testing.T) {
+	limit := stratum.MaxUpstreamRejects
+	stratum.MaxUpstreamRejects = 2
+	defer func() { stratum.MaxUpstreamRejects = limit }()
+
+	initServer()
+	addFakeOrder(&stratum.Order{
+		Id:       1,
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	}, stratumtest.Options{
+		Difficulty: stratum.DefaultMinDifficulty,
+		Submit: func(share *stratumtest.Share) error {
+			return stratumtest.ErrReject
+		},
+	})
+
+	client := stratum.NewClient(cli, make(chan error))
+	if err := client.Subscribe(); err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+	if err := client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x"); err != nil {
+		t.Fatalf("Failed on authorize: %v", err)
+	}
+	// shares must be valid at proxy to reach upstream, easy enough to mine
+	if err := client.SuggestDifficulty(stratum.DefaultMinDifficulty); err != nil {
+		t.Fatalf("Failed on suggest difficulty: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond) // wait for job
+	ctx := client.Context()
+	if err := client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", ctx.CurrentJob.Ntime, mineShare(ctx, "0001")); err != nil {
+		t.Fatalf("Valid share rejected: %v", err)
+	}
+	if state := orderState(t, 1); state == "banned" {
+		t.Fatalf("Order banned on first reject.")
+	}
+	client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0002", ctx.CurrentJob.Ntime, mineShare(ctx, "0002"))
+
+	for i := 0; i < 50 && orderState(t, 1) != "banned"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := orderState(t, 1); state != "banned" {
+		t.Fatalf("Order should be banned on upstream rejects, got %s", state)
+	}
+
+	closeServer()
+}
+
+func TestLowDifficultySharesNotForwarded(t *testing.T) {
+	limit := stratum.MaxUpstreamRejects
+	stratum.MaxUpstreamRejects = 2
+	defer func() { stratum.MaxUpstreamRejects = limit }()
+
+	initServer()
+	upstream := addFakeOrder(&stratum.Order{
+		Id:       1,
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	}, stratumtest.Options{
+		Submit: func(share *stratumtest.Share) error {
+			return errors.New("Low difficulty share")
+		},
+	})
+
+	client := subscribeWorker(t, cli)
+	ctx := client.Context()
+	for i := 0; i < 5; i++ {
+		err := client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", "504e86ed", fmt.Sprintf("%08x", i))
+		if e, ok := err.(*birpc.Error); !ok || e.Code != stratum.ErrorLowDifficultyShare {
+			t.Fatalf("Share below target accepted: %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(upstream.Shares()) != 0 {
+		t.Fatalf("Shares below target forwarded upstream: %+v", upstream.Shares())
+	}
+	if state := orderState(t, 1); state == "banned" {
+		t.Fatalf("Order banned on shares below target.")
+	}
+
+	closeServer()
+}
+
+func TestUpstreamTargetNotForwarded(t *testing.T) {
+	initServer()
+	upstream := addFakeOrder(&stratum.Order{
+		Id:       1,
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	}, stratumtest.Options{Difficulty: stratum.DefaultMinDifficulty})
+
+	client := stratum.NewClient(cli, make(chan error))
+	if err := client.Subscribe(); err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+	if err := client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x"); err != nil {
+		t.Fatalf("Failed on authorize: %v", err)
+	}
+	if err := client.SuggestDifficulty(stratum.DefaultMinDifficulty); err != nil {
+		t.Fatalf("Failed on suggest difficulty: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond) // wait for job
+
+	// upstream raised difficulty over worker difficulty
+	upstream.SetDifficulty(0.0004)
+	time.Sleep(20 * time.Millisecond)
+	ctx := client.Context()
+	err := client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0001", ctx.CurrentJob.Ntime, mineShare(ctx, "0001"))
+	if e, ok := err.(*birpc.Error); !ok || e.Code != stratum.ErrorLowDifficultyShare {
+		t.Fatalf("Share below upstream target accepted: %v", err)
+	}
+
+	// worker raised to upstream difficulty, its shares accepted and credited
+	time.Sleep(20 * time.Millisecond) // wait for notification
+	if ctx.Difficulty() != 0.0004 {
+		t.Fatalf("Worker difficulty should follow upstream, got %v", ctx.Difficulty())
+	}
+	if err := client.Submit(ctx.Username, ctx.CurrentJob.JobId, "0002", ctx.CurrentJob.Ntime, mineShare(ctx, "0002")); err != nil {
+		t.Fatalf("Share meeting upstream target rejected: %v", err)
+	}
+	var accounts []stratum.Account
+	for i := 0; i < 100 && len(accounts) == 0; i++ {
+		time.Sleep(time.Millisecond)
+		getJson(t, server.BalancesHandler, &accounts)
+	}
+	if shares := upstream.Shares(); len(shares) != 1 || !shares[0].Accepted || len(accounts) != 1 {
+		t.Fatalf("Only share meeting upstream target expected forwarded and credited: %+v, %+v", shares, accounts)
+	}
+
+	closeServer()
+}
+
+func TestStaleRejectsNotCounted(t *testing.T) {
+	limit := stratum.MaxUpstreamRejects
+	stratum.MaxUpstreamRejects = 2
+	defer func() { stratum.MaxUpstreamRejects = limit }()
+
+	initServer()
+	upstream := addFakeOrder(&stratum.Order{
+		Id:       1,
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	}, stratumtest.Options{
+		Difficulty: stratum.DefaultMinDifficulty,
+		Submit: func(share *stratumtest.Share) error {
+			return &stratumtest.Error{Code: stratum.ErrorJobNotFound, Message: "Job not found"}
+		},
+	})
+
+	client := stratum.NewClient(cli, make(chan error))
+	if err := client.Subscribe(); err != nil {
+		t.Fatalf("Failed on subscribe: %v", err)
+	}
+	if err := client.Authorize("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1", "x"); err != nil {
+		t.Fatalf("Failed on authorize: %v", err)
+	}
+	if err := client.SuggestDifficulty(stratum.DefaultMinDifficulty); err != nil {
+		t.Fatalf("Failed on suggest difficulty: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond) // wait for job
+	ctx := client.Context()
+	for _, en2 := range []string{"0001", "0002", "0003"} {
+		if err := client.Submit(ctx.Username, ctx.CurrentJob.JobId, en2, ctx.CurrentJob.Ntime, mineShare(ctx, en2)); err != nil {
+			t.Fatalf("Valid share rejected: %v", err)
+		}
+	}
+	for i := 0; i < 50 && len(upstream.Shares()) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // wait for results counted
+	if state := orderState(t, 1); state == "banned" {
+		t.Fatalf("Order banned on stale rejects.")
+	}
+
+	closeServer()
+}
+
+func TestCheckPool(t *testing.T) {
+	order := &stratum.Order{
+		Id:       1,
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	}
+	authorize := func(err error) func(string, string) error {
+		return func(username, password string) error { return err }
+	}
+	cases := []struct {
+		opts   stratumtest.Options
+		failed string
+	}{
+		{stratumtest.Options{Difficulty: 16}, ""},
+		{stratumtest.Options{Authorize: authorize(stratumtest.ErrReject)}, stratum.CheckAuthorize},
+		{stratumtest.Options{Authorize: authorize(stratumtest.ErrDisconnect)}, stratum.CheckAuthorize},
+		{stratumtest.Options{ExtraNonce2Size: 8}, stratum.CheckExtraNonce},
+		{stratumtest.Options{ManualJobs: true}, stratum.CheckJob},
+	}
+	for i, c := range cases {
+		fake := stratumtest.NewUnstartedPool(c.opts)
+		pcli, psrv := net.Pipe()
+		go fake.ServeConn(psrv)
+		check := stratum.CheckPoolWithConn(order, pcli, 500*time.Millisecond)
+		fake.Close()
+
+		last := check.Steps[len(check.Steps)-1]
+		if c.failed == "" {
+			if !check.Ok || len(check.Steps) != 5 || check.JobId != fake.JobId() ||
+				check.ExtraNonce1 != "08000002" || check.Difficulty != 16 {
+				t.Fatalf("Case %d: pool check should pass: %+v", i, check)
+			}
+			continue
+		}
+		if check.Ok || last.Ok || last.Name != c.failed || last.Error == "" {
+			t.Fatalf("Case %d: pool check should fail on %s: %+v", i, c.failed, check)
+		}
+	}
+}
+
+func TestCheckPoolSilent(t *testing.T) {
+	order := &stratum.Order{Id: 1, Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda"}
+	pcli, psrv := net.Pipe()
+	defer psrv.Close()
+	// pool never replies, not even to mining.configure
+	go io.Copy(ioutil.Discard, psrv)
+
+	start := time.Now()
+	check := stratum.CheckPoolWithConn(order, pcli, 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Pool check should end by its timeout: %v", elapsed)
+	}
+	last := check.Steps[len(check.Steps)-1]
+	if check.Ok || last.Ok || last.Error != stratum.ErrPoolCheckTimeout.Error() {
+		t.Fatalf("Pool check should time out: %+v", check)
+	}
+}
+
+func TestPoolCheckApi(t *testing.T) {
+	initServer()
+	fake := stratumtest.NewPool(stratumtest.Options{})
+	defer fake.Close()
+	server.AddOrder(&stratum.Order{
+		Id:       1,
+		Hostname: fake.Host(),
+		Port:     fake.Port(),
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	})
+
+	check := func(url, body string) *stratum.PoolCheck {
+		recorder := httptest.NewRecorder()
+		server.PoolCheckHandler(recorder, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		var check stratum.PoolCheck
+		if err := json.Unmarshal(recorder.Body.Bytes(), &check); err != nil {
+			t.Fatalf("Invalid json: %s, %s", err, recorder.Body.String())
+		}
+		return &check
+	}
+
+	// configured order on loopback, timeout capped
+	if c := check("/api/orders/check?id=1&timeout=1000h", ""); !c.Ok {
+		t.Fatalf("Pool check of order should pass: %+v", c)
+	}
+	for _, host := range []string{fake.Host(), "localhost", "10.1.2.3", "169.254.169.254"} {
+		c := check("/api/orders/check", `{"Hostname": "`+host+`", "Port": "`+fake.Port()+`", "Username": "x"}`)
+		if c.Ok || len(c.Steps) != 1 || c.Steps[0].Error != stratum.ErrPoolCheckTarget.Error() {
+			t.Fatalf("Pool check of %s should be refused: %+v", host, c)
+		}
+	}
+
+	closeServer()
+}
+
+func TestActiveOrderChecksPool(t *testing.T) {
+	timeout := stratum.DefaultPoolCheckTimeout
+	stratum.DefaultPoolCheckTimeout = 200 * time.Millisecond
+	defer func() { stratum.DefaultPoolCheckTimeout = timeout }()
+
+	good := stratumtest.NewPool(stratumtest.Options{})
+	defer good.Close()
+	// never sends a job
+	idle := stratumtest.NewPool(stratumtest.Options{ManualJobs: true})
+	defer idle.Close()
+
+	initServer()
+	config := &stratum.Config{}
+	for i, fake := range []*stratumtest.Pool{good, idle} {
+		config.Orders = append(config.Orders, &stratum.Order{
+			Id:       uint64(i + 11),
+			Hostname: fake.Host(),
+			Port:     fake.Port(),
+			Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+			Password: "x",
+		})
+	}
+	if err := server.Reload(config); err != nil {
+		t.Fatalf("Failed to reload config: %s", err)
+	}
+	for i := 0; i < 100 && (orderState(t, 11) != "connected" || orderState(t, 12) != "dead"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := orderState(t, 11); state != "connected" {
+		t.Fatalf("Order passed pool check should go live, got %s", state)
+	}
+	if state := orderState(t, 12); state != "dead" {
+		t.Fatalf("Order failed pool check should not go live, got %s", state)
+	}
+	// connected by check only
+	if idle.Connects() != 1 || good.Connects() != 2 {
+		t.Fatalf("Unexpected connects, good %d, idle %d", good.Connects(), idle.Connects())
+	}
+
+	closeServer()
+}
+
+func TestPoolAuthorize(t *testing.T) {
+	busy := &stratumtest.Error{Code: stratum.ErrorUnknown, Message: "Busy"}
+	for _, policy := range []error{stratumtest.ErrReject, errors.New("Unauthorized worker"), busy, stratumtest.ErrDisconnect} {
+		fake := stratumtest.NewPool(stratumtest.Options{
+			Authorize: func(username, password string) error { return policy },
+		})
+		order := &stratum.Order{
+			Id:       1,
+			Hostname: fake.Host(),
+			Port:     fake.Port(),
+			Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+			Password: "x",
+		}
+		_, err := stratum.NewPool(order, make(chan error, 1))
+		fake.Close()
+		if policy == stratumtest.ErrDisconnect || policy == busy {
+			if _, ok := err.(*stratum.AuthError); !ok {
+				t.Fatalf("Pool replied %s should be AuthError: %v", policy, err)
+			}
+		} else if err != stratum.ErrAuthRejected {
+			t.Fatalf("Pool replied %s should reject: %v", policy, err)
+		}
+	}
+}
+
+func TestOrderBannedOnAuthReject(t *testing.T) {
+	fake := stratumtest.NewPool(stratumtest.Options{
+		Authorize: func(username, password string) error { return stratumtest.ErrReject },
+	})
+	defer fake.Close()
+
+	initServer()
+	server.AddOrder(&stratum.Order{
+		Id:       1,
+		Hostname: fake.Host(),
+		Port:     fake.Port(),
+		Username: "1PJ1DVi5n6T4NisfnVbYmL17a4WNfaFsda",
+		Password: "x",
+	})
+	if err := server.BanOrder(1, "test"); err != nil {
+		t.Fatalf("Failed to ban: %s", err)
+	}
+	// unban connects again
+	if err := server.UnbanOrder(1); err != nil {
+		t.Fatalf("Failed to unban: %s", err)
+	}
+	for i := 0; i < 100 && orderState(t, 1) != "banned"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if state := orderState(t, 1); state != "banned" {
+		t.Fatalf("Order should be banned on credentials rejected, got %s", state)
+	}
+
+	closeServer()
+}
+
+// waitConnects waits fake pool served n connections.
+func waitConnects(t *testing.T, fake *stratumtest.Pool, n int) {
+	for i := 0; i < 100 && fake.Connects() < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fake.Connects() != n {
+		t.Fatalf("Expected %d connections to pool %s, got %d", n, fake.Addr(), fake.Connects())
+	}
+}
+
+func TestUpstreamReconnect(t *testing.T) {
+	initServer()
+	upstream := addOrder()
+	other := stratumtest.NewPool(stratumtest.Options{})
+	fakes = append(fakes, other)
+
+	upstream.Reconnect("", 0, 0)
+	waitConnects(t, upstream, 2)
+
+	// redirect to another port of the host
+	port, _ := strconv.Atoi(other.Port())
+	upstream.Reconnect(other.Host(), port, 0)
+	waitConnects(t, other, 1)
+
+	// other host is never followed
+	other.Reconnect("10.0.0.1", 3333, 0)
+	waitConnects(t, upstream, 3)
+	waitConnects(t, other, 1)
+
+	for i := 0; i < 100 && orderState(t, 1) != "connected"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var pools []stratum.PoolStats
+	getJson(t, server.PoolsHandler, &pools)
+	if len(pools) != 1 || pools[0].Address != upstream.Addr() || pools[0].State != "connected" {
+		t.Fatalf("Pool should reconnect to order host: %+v", pools)
+	}
+
+	closeServer()
+}
+
+func TestEvents(t *testing.T) {
+	initServer()
+
+	pipeClient, pipeServer := net.Pipe()
+	httpServer := http.Server{Handler: server.EventsHandler()}
+	go httpServer.Serve(oneshotlisten.New(pipeServer))
+
+	conf, _ := websocket.NewConfig("http://fakeserver.test/events", "http://fakeserver.test/")
+	ws, err := websocket.NewClient(conf, pipeClient)
+	if err != nil {
+		t.Fatalf("websocket client failed to start: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond) // wait for registration
+
+	addOrder()
+
+	// events of workers left by previous tests are skipped
+	events := make(map[string]map[string]interface{})
+	for events[stratum.EventJob] == nil || events[stratum.EventPoolState]["state"] != "connected" {
+		var msg birpc.Message
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatalf("Events not received: %v, got %v", err, events)
+		}
+		if msg.Func != "Dashboard.Event" {
+			t.Fatalf("Unexpected message: %#v", msg)
+		}
+		event := msg.Args.(map[string]interface{})
+		events[event["type"].(string)] = event["data"].(map[string]interface{})
+	}
+
+	if events[stratum.EventJob]["job_id"] == "" || events[stratum.EventJob]["order"] != 1.0 {
+		t.Fatalf("Unexpected job event: %v", events)
+	}
+
+	ws.Close()
+	closeServer()
+}
@@ -0,0 +1,74 @@
+package stratum
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+const shareSetShards = 16
+
+// ShareSet records submitted shares of a single job for duplicate
+// detection. It is safe for concurrent use, shares are spread across
+// shards so submitters on different connections rarely contend on the
+// same lock.
+//
+// The set lives as long as its job, memory is released when the pool
+// drops the job.
+type ShareSet struct {
+	shards [shareSetShards]shareShard
+}
+
+type shareShard struct {
+	lock   sync.Mutex
+	shares map[string]struct{}
+}
+
+func NewShareSet() *ShareSet {
+	s := &ShareSet{}
+	for i := range s.shards {
+		s.shards[i].shares = make(map[string]struct{})
+	}
+	return s
+}
+
+// Add records the share, returns false if the share was already seen.
+// version is the block version of share, rolled by miner or not.
+func (s *ShareSet) Add(extraNonce1, extraNonce2, ntime, nonce, version string) bool {
+	key := shareKey(extraNonce1 + extraNonce2 + ntime + nonce + version)
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	shard := &s.shards[h.Sum32()%shareSetShards]
+
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if _, ok := shard.shares[key]; ok {
+		return false
+	}
+	shard.shares[key] = struct{}{}
+	return true
+}
+
+// Len returns number of shares recorded.
+func (s *ShareSet) Len() int {
+	n := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		n += len(shard.shares)
+		shard.lock.Unlock()
+	}
+	return n
+}
+
+// shareKey normalizes submission, miner can not resubmit the same work by
+// changing hex case. Decoded bytes also take half the memory.
+func shareKey(submission string) string {
+	buf, err := hex.DecodeString(submission)
+	if err != nil {
+		return strings.ToLower(submission)
+	}
+	return string(buf)
+}
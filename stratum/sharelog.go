@@ -0,0 +1,386 @@
+package stratum
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Share log keeps every submitted share as a line of json under data dir,
+// buyers audit delivered work and billing is recomputed from it after
+// incidents. Current file is shares.log, rotated to shares-<time>.log when
+// it grows over max size or a share of the next day is appended, <time> is
+// of rotation, so files sort in written order and all shares in a file are
+// before its time.
+const (
+	ShareLogName           = "shares.log"
+	MaxShareLogSize        = 64 << 20
+	DefaultShareQueryLimit = 1000
+)
+
+// Upstream result of share.
+const (
+	UpstreamPending  = "pending"
+	UpstreamAccepted = "accepted"
+	UpstreamRejected = "rejected"
+)
+
+const shareLogTimeFormat = "20060102-150405.000000000"
+
+var ErrShareLogClosed = errors.New("Share log closed.")
+
+// ShareRecord is a share submitted by worker. Accepted share is logged
+// pending when submitted to upstream, then logged again with upstream
+// result, query merges them into one record.
+type ShareRecord struct {
+	Time          time.Time
+	Worker        string
+	Order         uint64
+	JobId         string `json:",omitempty"`
+	UpstreamJobId string `json:",omitempty"`
+	Difficulty    float64
+	Hash          string `json:",omitempty"`
+	Result        string // accepted, rejected or stale
+	Reason        string `json:",omitempty"`
+	Upstream      string `json:",omitempty"` // empty if not submitted
+	UpstreamError string `json:",omitempty"`
+	Block         bool   `json:",omitempty"` // met network target
+}
+
+// pending returns true if upstream result of share is still to be logged.
+func (r *ShareRecord) pending() bool {
+	return r.Upstream == UpstreamPending
+}
+
+type ShareLog struct {
+	lock    sync.Mutex
+	dir     string
+	maxSize int64
+	file    *os.File
+	size    int64
+	last    time.Time // time of latest share in current file
+}
+
+// OpenShareLog opens share log in dir for appending, dir is created if
+// not exists.
+func OpenShareLog(dir string, maxSize int64) (*ShareLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &ShareLog{dir: dir, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *ShareLog) open() error {
+	file, err := os.OpenFile(filepath.Join(l.dir, ShareLogName),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	l.last = time.Time{}
+	if l.size > 0 {
+		l.last = info.ModTime()
+	}
+	return nil
+}
+
+// Append writes share to log, each share is a single write so a crash
+// loses at most the last line.
+func (l *ShareLog) Append(r *ShareRecord) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return ErrShareLogClosed
+	}
+	if l.size > 0 && (l.size+int64(len(line)) > l.maxSize || laterDay(r.Time, l.last)) {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if r.Time.After(l.last) {
+		l.last = r.Time
+	}
+	return err
+}
+
+// laterDay returns true if t is on a day after last.
+func laterDay(t, last time.Time) bool {
+	y1, m1, d1 := t.Date()
+	y2, m2, d2 := last.Date()
+	if y1 != y2 {
+		return y1 > y2
+	}
+	if m1 != m2 {
+		return m1 > m2
+	}
+	return d1 > d2
+}
+
+func (l *ShareLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	now := time.Now()
+	name := filepath.Join(l.dir, "shares-"+now.Format(shareLogTimeFormat)+".log")
+	for {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		now = now.Add(time.Nanosecond)
+		name = filepath.Join(l.dir, "shares-"+now.Format(shareLogTimeFormat)+".log")
+	}
+	if err := os.Rename(filepath.Join(l.dir, ShareLogName), name); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Flush syncs log to disk.
+func (l *ShareLog) Flush() error {
+	if l == nil {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+func (l *ShareLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// ShareQuery filters shares, zero fields match all.
+type ShareQuery struct {
+	Worker string
+	Order  uint64
+	Result string
+	Since  time.Time
+	Until  time.Time
+	Limit  int // last shares matched returned, DefaultShareQueryLimit if 0
+}
+
+func (q *ShareQuery) match(r *ShareRecord) bool {
+	if q.Worker != "" && r.Worker != q.Worker {
+		return false
+	}
+	if q.Order != 0 && r.Order != q.Order {
+		return false
+	}
+	if q.Result != "" && r.Result != q.Result {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// logReader is a log file opened for query, current log is read up to
+// its size when opened.
+type logReader struct {
+	file *os.File
+	size int64
+}
+
+// readers opens log files in time order, rotated files with shares all
+// before since are skipped.
+func (l *ShareLog) readers(since time.Time) ([]*logReader, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	names, err := filepath.Glob(filepath.Join(l.dir, "shares-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	readers := []*logReader{}
+	for _, name := range names {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), "shares-"), ".log")
+		rotated, err := time.ParseInLocation(shareLogTimeFormat, stamp, time.Local)
+		if err == nil && rotated.Before(since) {
+			continue
+		}
+		file, err := os.Open(name)
+		if err != nil {
+			closeReaders(readers)
+			return nil, err
+		}
+		readers = append(readers, &logReader{file: file, size: -1})
+	}
+
+	file, err := os.Open(filepath.Join(l.dir, ShareLogName))
+	if err != nil {
+		closeReaders(readers)
+		return nil, err
+	}
+	return append(readers, &logReader{file: file, size: l.size}), nil
+}
+
+func closeReaders(readers []*logReader) {
+	for _, r := range readers {
+		r.file.Close()
+	}
+}
+
+// Query returns the last shares matched up to limit of query in time
+// order, pending shares with upstream result logged are merged. Only the
+// last shares are held while logs are read.
+func (l *ShareLog) Query(q *ShareQuery) ([]*ShareRecord, error) {
+	readers, err := l.readers(q.Since)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReaders(readers)
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultShareQueryLimit
+	}
+	// ring of last records matched, oldest at next once full
+	records := []*ShareRecord{}
+	next := 0
+	pending := make(map[string]*ShareRecord)
+	for _, reader := range readers {
+		var in io.Reader = reader.file
+		if reader.size >= 0 {
+			in = io.LimitReader(reader.file, reader.size)
+		}
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			r := &ShareRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+				// partial line of a crash
+				continue
+			}
+			key := strconv.FormatUint(r.Order, 10) + "/" + r.Hash
+			if r.pending() {
+				pending[key] = r
+			} else if prev, ok := pending[key]; ok && r.Upstream != "" {
+				delete(pending, key)
+				*prev = *r
+				continue
+			}
+			if !q.match(r) {
+				continue
+			}
+			if len(records) < limit {
+				records = append(records, r)
+			} else {
+				records[next] = r
+				next = (next + 1) % limit
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return append(records[next:], records[:next]...), nil
+}
+
+// logShare appends share to share log if data dir configured.
+func (s *StratumServer) logShare(r *ShareRecord) {
+	if s == nil || s.shares == nil {
+		return
+	}
+	if err := s.shares.Append(r); err != nil {
+		log.Printf("Failed to log share: %s", err)
+	}
+}
+
+// ShareLog returns share log of server, nil if no data dir configured.
+func (s *StratumServer) ShareLog() *ShareLog {
+	return s.shares
+}
+
+// SharesHandler serves the last shares queried by worker, order, result,
+// since, until (RFC 3339) and limit.
+func (s *StratumServer) SharesHandler(w http.ResponseWriter, r *http.Request) {
+	if s.shares == nil {
+		http.Error(w, "Share log not enabled.", http.StatusNotFound)
+		return
+	}
+	params := r.URL.Query()
+	q := &ShareQuery{
+		Worker: params.Get("worker"),
+		Result: params.Get("result"),
+	}
+	var err error
+	if v := params.Get("order"); v != "" {
+		if q.Order, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "Invalid order.", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid since.", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid until.", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid limit.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := s.shares.Query(q)
+	if err != nil {
+		log.Printf("Failed to query shares: %s", err)
+		http.Error(w, "Share log error.", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, records)
+}
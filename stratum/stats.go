@@ -0,0 +1,149 @@
+package stratum
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Fixed windows of hashrate.
+var (
+	ShortHashrateWindow = time.Duration(5) * time.Minute
+	LongHashrateWindow  = time.Duration(1) * time.Hour
+)
+
+type WorkerStats struct {
+	Name         string
+	RemoteAddr   string
+	Difficulty   float64
+	Hashrate     Hashrate
+	Accepted     int
+	Rejected     int
+	LastShare    *time.Time
+	MinerVersion string
+	Pool         uint64 // order id of bound pool, 0 if unbound
+	Connected    time.Time
+}
+
+type PoolStats struct {
+	Id                 uint64
+	Address            string
+	State              string
+	Available          bool
+	UpstreamDifficulty float64
+	CurrentJob         string
+	Workers            int
+	Hashrate           Hashrate
+}
+
+type OrderStats struct {
+	Id        uint64
+	Algorithm string
+	State     string
+	Price     uint64
+	MaxPrice  uint64
+	Amount    uint64
+	Hashrate  Hashrate // delivered
+	Spent     float64  // satoshi
+	Vip       bool
+	FeeRate   float64
+	Fee       float64 // satoshi billed
+	Reserved  float64 // hashrate reserved now
+	// reservations not expired
+	Reservations []Reservation
+}
+
+func (p *Pool) Stats() *PoolStats {
+	stats := &PoolStats{
+		Id:        p.id,
+		Address:   p.address,
+		State:     StateName(p.order.state()),
+		Available: p.isAvailable(),
+		Workers:   p.workerCount(),
+		Hashrate:  p.hashrate(),
+	}
+	p.lock.Lock()
+	if p.CurrentJob != nil {
+		stats.CurrentJob = p.CurrentJob.JobId
+	}
+	p.lock.Unlock()
+	if ctx := p.Context(); ctx != nil {
+		stats.UpstreamDifficulty = ctx.Difficulty()
+	}
+	return stats
+}
+
+func (od *Order) Stats() *OrderStats {
+	stats := &OrderStats{
+		Id:        od.Id,
+		Algorithm: od.Algorithm,
+		State:     StateName(od.state()),
+		Price:     od.price(),
+		MaxPrice:  od.MaxPrice,
+		Amount:    od.Amount,
+		Spent:     od.Spent(),
+		Hashrate:  od.Hashrate(),
+		Vip:       od.Vip,
+	}
+	return stats
+}
+
+// Orders returns a snapshot of orders, ordered by id.
+func (s *StratumServer) Orders() []*Order {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	orders := make([]*Order, 0, len(s.orders))
+	for _, order := range s.orders {
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].Id < orders[j].Id })
+	return orders
+}
+
+func (s *StratumServer) WorkersHandler(w http.ResponseWriter, r *http.Request) {
+	workers := s.Workers()
+	stats := make([]*WorkerStats, len(workers))
+	for i, worker := range workers {
+		stats[i] = worker.Stats()
+	}
+	writeJson(w, stats)
+}
+
+func (s *StratumServer) PoolsHandler(w http.ResponseWriter, r *http.Request) {
+	pools := s.Pools()
+	stats := make([]*PoolStats, len(pools))
+	for i, pool := range pools {
+		stats[i] = pool.Stats()
+	}
+	writeJson(w, stats)
+}
+
+func (s *StratumServer) OrdersHandler(w http.ResponseWriter, r *http.Request) {
+	orders := s.Orders()
+	stats := make([]*OrderStats, len(orders))
+	for i, order := range orders {
+		stats[i] = order.Stats()
+		stats[i].FeeRate = s.ledger.Fees().Rate(order)
+		if bill, ok := s.ledger.Bill(order.Id); ok {
+			stats[i].Fee = bill.Fee
+		}
+		now := time.Now()
+		stats[i].Reserved = s.reserves.Active(order.Id, now)
+		stats[i].Reservations = s.reserves.List(order.Id, now)
+	}
+	writeJson(w, stats)
+}
+
+// NamesHandler serves hashrate by worker name.
+func (s *StratumServer) NamesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, s.NameHashrates())
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write json: %s", err)
+	}
+}
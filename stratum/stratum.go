@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"github.com/conformal/btcnet"
 	"github.com/conformal/btcutil"
 	"github.com/conformal/btcwire"
@@ -12,6 +13,7 @@ import (
 	"log"
 	"math"
 	"math/big"
+	"math/bits"
 	"strings"
 	"sync"
 	"time"
@@ -21,6 +23,8 @@ import (
 type Stratum struct {
 	broadcast *topic.Topic
 	registry  *birpc.Registry
+	closeLock sync.RWMutex
+	closed    bool
 }
 
 func NewStratum() *Stratum {
@@ -34,9 +38,29 @@ func NewStratum() *Stratum {
 }
 
 func (s *Stratum) close() {
+	s.closeLock.Lock()
+	defer s.closeLock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
 	close(s.broadcast.Broadcast)
 }
 
+// publish sends msg to broadcast topic subscribers, msg is dropped rather
+// than blocking the caller when topic is busy.
+func (s *Stratum) publish(msg interface{}) {
+	s.closeLock.RLock()
+	defer s.closeLock.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.broadcast.Broadcast <- msg:
+	default:
+	}
+}
+
 type Mining struct{}
 
 func (m *Mining) rpcError(errCode int) *birpc.Error {
@@ -48,6 +72,18 @@ func (m *Mining) rpcUnknownError(errMsg string) *birpc.Error {
 	return &birpc.Error{ErrorUnknown, errMsg, nil}
 }
 
+// ntime rejection carries job ntime and offset, so miners with drifting
+// clocks are diagnosable from their logs.
+func (m *Mining) rpcNtimeError(job *Job, ntime string, offset int64) *birpc.Error {
+	err := m.rpcError(ErrorNtimeOutOfRange)
+	err.Data = map[string]interface{}{
+		"ntime":     ntime,
+		"job_ntime": job.Ntime,
+		"offset":    offset,
+	}
+	return err
+}
+
 func (m *Mining) Subscribe(req *interface{}, reply *interface{}, e *birpc.Endpoint) error {
 	context := e.Context.(*Context)
 
@@ -85,18 +121,94 @@ func (m *Mining) Subscribe(req *interface{}, reply *interface{}, e *birpc.Endpoi
 	return nil
 }
 
+// mining.configure, BIP310. Only version-rolling extension supported, mask
+// is narrowed to pool's mask once worker bound to a pool.
+func (m *Mining) Configure(args *interface{}, reply *interface{}, e *birpc.Endpoint) error {
+	context, ok := e.Context.(*Context)
+	if !ok {
+		return m.rpcUnknownError("mining.configure not supported")
+	}
+
+	params, ok := (*args).([]interface{})
+	if !ok || len(params) < 2 {
+		return m.rpcUnknownError("invalid mining.configure params")
+	}
+	extensions, _ := params[0].([]interface{})
+	extParams, _ := params[1].(map[string]interface{})
+
+	result := make(map[string]interface{})
+	for _, ext := range extensions {
+		name, _ := ext.(string)
+		if name != "version-rolling" {
+			result[name] = false
+			continue
+		}
+
+		mask := uint32(DefaultVersionMask)
+		if hexMask, ok := extParams["version-rolling.mask"].(string); ok {
+			requested, err := HexToUint32(hexMask)
+			if err != nil {
+				return m.rpcUnknownError("invalid version-rolling.mask")
+			}
+			mask &= requested
+		}
+		if context.pool != nil {
+			mask &= context.pool.versionMask()
+		}
+
+		minBits, _ := extParams["version-rolling.min-bit-count"].(float64)
+		if bits.OnesCount32(mask) < int(minBits) || mask == 0 {
+			result[name] = false
+			continue
+		}
+
+		context.lock()
+		context.VersionRolling = true
+		context.VersionMask = mask
+		context.unlock()
+		result[name] = true
+		result["version-rolling.mask"] = fmt.Sprintf("%08x", mask)
+	}
+
+	*reply = result
+	return nil
+}
+
+// mining.set_version_mask notification from upstream
+func (m *Mining) Set_version_mask(args *interface{}, reply *interface{}, e *birpc.Endpoint) error {
+	ctx, ok := e.Context.(*ClientContext)
+	if !ok {
+		return m.rpcUnknownError("mining.set_version_mask not supported")
+	}
+
+	params := birpc.List((*args).([]interface{}))
+	mask, err := HexToUint32(params[0].(string))
+	if err != nil {
+		return m.rpcUnknownError("invalid version mask")
+	}
+	ctx.setVersionMask(mask)
+	log.Printf("mining.set_version_mask to %08x\n", mask)
+	if pool, ok := ctx.pool(); ok {
+		pool.narrowVersionMask(mask)
+	}
+	return nil
+}
+
 // server mining.notify -> client
 func (m *Mining) notifyAfterSubscribe(e *birpc.Endpoint) {
 	e.WaitServer()
 
 	context := e.Context.(*Context)
 
-	// set difficulty
 	var msg birpc.Message
-	msg.ID = 0
-	msg.Func = "mining.set_difficulty"
-	msg.Args = &birpc.List{DefaultDifficulty}
-	e.Notify(&msg)
+
+	// version mask negotiated before subscribe may be wider than pool's
+	if context.worker != nil {
+		context.worker.narrowVersionMask(context.pool.versionMask())
+	}
+
+	// set difficulty
+	m.setDifficulty(e, context.startDifficulty())
 
 	job, err := context.CurrentJob()
 	if err != nil {
@@ -112,6 +224,82 @@ func (m *Mining) notifyAfterSubscribe(e *birpc.Endpoint) {
 	e.Notify(&msg)
 }
 
+// setDifficulty sends mining.set_difficulty to worker.
+func (m *Mining) setDifficulty(e *birpc.Endpoint, diff float64) {
+	context := e.Context.(*Context)
+	if diff == context.Difficulty {
+		return
+	}
+	context.lock()
+	context.PrevDifficulty = context.Difficulty
+	context.Difficulty = diff
+	context.unlock()
+	context.vardiff.Reset(time.Now())
+
+	var msg birpc.Message
+	msg.ID = 0
+	msg.Func = "mining.set_difficulty"
+	msg.Args = &birpc.List{diff}
+	e.Notify(&msg)
+}
+
+// suggestDifficulty records difficulty suggested by miner, applied at once
+// if already subscribed.
+func (m *Mining) suggestDifficulty(e *birpc.Endpoint, diff float64) {
+	context := e.Context.(*Context)
+	context.Suggested = diff
+	log.Printf("Worker suggest difficulty %v, clamped to %v", diff, context.clampDifficulty(diff))
+	if context.subscribed() {
+		m.setDifficulty(e, context.clampDifficulty(diff))
+	}
+}
+
+// mining.suggest_difficulty, valid before or after subscribe.
+func (m *Mining) Suggest_difficulty(args *interface{}, reply *bool, e *birpc.Endpoint) error {
+	if _, ok := e.Context.(*Context); !ok {
+		return m.rpcUnknownError("mining.suggest_difficulty not supported")
+	}
+
+	params, ok := (*args).([]interface{})
+	if !ok || len(params) < 1 {
+		return m.rpcUnknownError("invalid difficulty")
+	}
+	diff, ok := params[0].(float64)
+	if !ok || diff <= 0 {
+		return m.rpcUnknownError("invalid difficulty")
+	}
+
+	m.suggestDifficulty(e, diff)
+	*reply = true
+	return nil
+}
+
+// mining.suggest_target, target in hex, valid before or after subscribe.
+func (m *Mining) Suggest_target(args *interface{}, reply *bool, e *birpc.Endpoint) error {
+	context, ok := e.Context.(*Context)
+	if !ok {
+		return m.rpcUnknownError("mining.suggest_target not supported")
+	}
+
+	params, ok := (*args).([]interface{})
+	if !ok || len(params) < 1 {
+		return m.rpcUnknownError("invalid target")
+	}
+	hexTarget, _ := params[0].(string)
+	target, ok := new(big.Int).SetString(hexTarget, 16)
+	if !ok || target.Sign() <= 0 {
+		return m.rpcUnknownError("invalid target")
+	}
+
+	algorithm := context.algorithm
+	if algorithm == nil {
+		algorithm = SHA256
+	}
+	m.suggestDifficulty(e, algorithm.Difficulty(target))
+	*reply = true
+	return nil
+}
+
 // upstream mining.notify -> server
 func (m *Mining) Notify(args *interface{}, reply *interface{}, e *birpc.Endpoint) error {
 	log.Printf("mining.notify\n")
@@ -134,11 +322,14 @@ func (m *Mining) Notify(args *interface{}, reply *interface{}, e *birpc.Endpoint
 // mining.set_difficulty notification from upstream
 func (m *Mining) Set_difficulty(args *interface{}, reply *interface{}, e *birpc.Endpoint) error {
 	ctx := e.Context.(*ClientContext)
-	ctx.PrevDifficulty = ctx.Difficulty
-
 	params := birpc.List((*args).([]interface{}))
-	ctx.Difficulty = params[0].(float64)
-	log.Printf("mining.set_difficulty to %.3f\n", ctx.Difficulty)
+	diff := params[0].(float64)
+
+	ctx.lock.Lock()
+	ctx.prevDifficulty = ctx.difficulty
+	ctx.difficulty = diff
+	ctx.lock.Unlock()
+	log.Printf("mining.set_difficulty to %.3f\n", diff)
 	return nil
 }
 
@@ -147,16 +338,31 @@ func (m *Mining) Authorize(args *interface{}, reply *bool, e *birpc.Endpoint) er
 	username := params[0].(string)
 	password := params[1].(string)
 
-	_, err := btcutil.DecodeAddress(username, &btcnet.MainNetParams)
+	address, workerName, diff := parseUsername(username)
+	_, err := btcutil.DecodeAddress(address, &btcnet.MainNetParams)
 	if err != nil {
+		m.showMessage(e, "Username must be a valid bitcoin address: "+address)
+		e.WaitClose()
+		*reply = false
+	} else if DefaultServer != nil && DefaultServer.bannedAddress(address) {
+		log.Printf("Banned address %s rejected.", address)
+		m.showMessage(e, "Address banned: "+address)
 		e.WaitClose()
 		*reply = false
 	} else {
 		// authented
 		context := e.Context.(*Context)
+		context.lock()
 		context.Username = username
 		context.Password = password
+		context.Address = address
+		context.WorkerName = workerName
 		context.Authorized = true
+		context.unlock()
+
+		if diff > 0 {
+			m.suggestDifficulty(e, diff)
+		}
 
 		*reply = true
 	}
@@ -164,7 +370,49 @@ func (m *Mining) Authorize(args *interface{}, reply *bool, e *birpc.Endpoint) er
 	return nil
 }
 
+// showMessage sends client.show_message to miner.
+func (m *Mining) showMessage(e *birpc.Endpoint, message string) {
+	var msg birpc.Message
+	msg.ID = 0
+	msg.Func = "client.show_message"
+	msg.Args = &birpc.List{message}
+	e.Notify(&msg)
+}
+
 func (m *Mining) Submit(args *interface{}, reply *bool, e *birpc.Endpoint) error {
+	share := &ShareRecord{Time: time.Now()}
+	err := m.submit(args, reply, e, share)
+	context, ok := e.Context.(*Context)
+	if !ok {
+		return err
+	}
+	if context.worker != nil {
+		context.worker.countShare(err == nil, time.Now())
+	}
+	if context.pool != nil {
+		serverMetrics().share(context.pool.id, err)
+		result, reason := shareResult(err)
+		publishEvent(EventShare, &ShareEvent{
+			Order:      context.pool.id,
+			Worker:     context.Username,
+			Difficulty: context.Difficulty,
+			Result:     result,
+			Reason:     reason,
+		})
+		// accepted share is logged by pool with upstream result
+		if err != nil {
+			share.Worker = context.Username
+			share.Order = context.pool.id
+			share.Difficulty = context.Difficulty
+			share.Result, share.Reason = result, reason
+			DefaultServer.logShare(share)
+		}
+	}
+	return err
+}
+
+// submit verifies share, fields of share record are filled as verified.
+func (m *Mining) submit(args *interface{}, reply *bool, e *birpc.Endpoint, share *ShareRecord) error {
 	params := (*args).([]interface{})
 	log.Printf("params: %v", params)
 	username := params[0].(string)
@@ -172,6 +420,10 @@ func (m *Mining) Submit(args *interface{}, reply *bool, e *birpc.Endpoint) error
 	extraNonce2 := params[2].(string)
 	ntime := params[3].(string)
 	nonce := params[4].(string)
+	versionBits := ""
+	if len(params) > 5 {
+		versionBits, _ = params[5].(string)
+	}
 
 	context := e.Context.(*Context)
 
@@ -196,54 +448,154 @@ func (m *Mining) Submit(args *interface{}, reply *bool, e *birpc.Endpoint) error
 	}
 
 	pool := context.pool
-	job, ok := pool.jobs[jobId]
+	share.JobId = jobId
+	job, ok := pool.findJob(jobId)
 	if !ok {
 		return m.rpcError(ErrorJobNotFound)
 	}
+	share.UpstreamJobId = job.UpstreamJobId
 
 	if len(ntime) != 8 {
 		return m.rpcUnknownError("incorrect size of ntime")
 	}
 
-	ntimeInt, _ := HexToInt64(ntime)
-	if ntimeInt > submitTime+7200 {
-		return m.rpcUnknownError("ntime out of range")
+	ntimeInt, err := HexToInt64(ntime)
+	if err != nil {
+		return m.rpcUnknownError("incorrect ntime")
+	}
+	if offset, ok := pool.ntimePolicy().verify(job, ntimeInt, submitTime); !ok {
+		log.Printf("[Proxy] ntime %s out of range from %s, %+ds to job #%s ntime %s",
+			ntime, username, offset, jobId, job.Ntime)
+		return m.rpcNtimeError(job, ntime, offset)
 	}
 
 	if len(nonce) != 8 {
 		return m.rpcUnknownError("incorrect size of nonce")
 	}
 
-	submission := context.ExtraNonce1 + extraNonce2 + ntime + nonce
-	if err := job.submit(submission); err != nil {
+	version := job.Version
+	if versionBits != "" {
+		if !context.VersionRolling {
+			return m.rpcUnknownError("version rolling not negotiated")
+		}
+		context.lock()
+		mask := context.VersionMask
+		context.unlock()
+		version, err = RollVersion(job.Version, versionBits, mask)
+		if err != nil {
+			return m.rpcUnknownError("invalid version bits")
+		}
+	}
+
+	if err := job.submit(context.ExtraNonce1, extraNonce2, ntime, nonce, version); err != nil {
 		return m.rpcError(ErrorDuplicateShare)
 	}
 
 	// target check
 	merkleRoot := job.MerkleRoot(context.ExtraNonce1, extraNonce2)
-	header, err := SerializeHeader(job, merkleRoot, ntime, nonce)
+	header, err := SerializeHeaderWithVersion(job, merkleRoot, version, ntime, nonce)
 	if err != nil {
 		return m.rpcUnknownError("job error")
 	}
 	headerHash, _ := header.BlockSha()
 	log.Printf("header hash: %s", headerHash.String())
-	shareDiff := ShaHashToBig(&headerHash)
+	share.Hash = headerHash.String()
+	powHash, err := context.algorithm.HashHeader(header)
+	if err != nil {
+		return m.rpcUnknownError("job error")
+	}
+	shareDiff := ShaHashToBig(powHash)
+
+	if isBlockCandidate(job, shareDiff) {
+		share.Block = true
+		block := NewBlockCandidate(pool, job, username, header)
+		log.Printf("[Block] candidate found by %s, order #%d, job #%s(%s), hash: %s, header: %s",
+			username, block.OrderId, block.JobId, block.UpstreamJobId, block.Hash, block.Header)
+		if DefaultServer != nil {
+			DefaultServer.addBlockCandidate(block)
+		}
+	}
 
-	target := DiffToTarget(int64(1))
-	if shareDiff.Cmp(target) > 0 {
+	// block candidates always go upstream, whatever the worker target
+	shareDifficulty := context.shareDifficulty()
+	target := context.algorithm.Target(shareDifficulty)
+	if !share.Block && shareDiff.Cmp(target) > 0 {
 		log.Printf("share difficulty not meet the target.")
-		// DEBUG: testing submit low diff share, will remove in production
-		go pool.submit(jobId, context.ExtraNonce1, extraNonce2, ntime, nonce, headerHash.String())
+		return m.rpcError(ErrorLowDifficultyShare)
+	}
+	// shares upstream would reject are never forwarded, nor accepted
+	if upstreamDiff := pool.upstreamDifficulty(); !share.Block && upstreamDiff > 0 &&
+		shareDiff.Cmp(context.algorithm.Target(upstreamDiff)) > 0 {
+		log.Printf("share difficulty not meet the upstream target.")
+		// upstream raised difficulty since worker got its own
+		m.setDifficulty(e, context.clampDifficulty(context.Difficulty))
 		return m.rpcError(ErrorLowDifficultyShare)
 	}
 
-	go pool.submit(jobId, context.ExtraNonce1, extraNonce2, ntime, nonce, headerHash.String())
+	share.Worker = username
+	share.Order = pool.id
+	share.Difficulty = shareDifficulty
+	share.Result = "accepted"
+	err = pool.submitAsync(job, context.ExtraNonce1, extraNonce2, ntime, nonce, versionBits, headerHash.String(), share)
+	if err != nil {
+		log.Printf("[Proxy] share dropped: #%s, %s", jobId, err)
+		return m.rpcUnknownError(err.Error())
+	}
 
 	*reply = true
 	log.Printf("[Proxy] share accepted: #%s, hash: %s\n", jobId, headerHash.String())
+	now := time.Now()
+	pool.addShare(shareDifficulty, now)
+	if context.worker != nil {
+		context.worker.updateShareLists(shareDifficulty, now)
+		if DefaultServer != nil {
+			DefaultServer.addNameShare(context.name(), context.algorithm, shareDifficulty, now)
+		}
+	}
+
+	if context.listener != nil && DefaultServer != nil {
+		vardiff := DefaultServer.vardiffOptions(context.listener)
+		diff, ok := context.vardiff.Retarget(&vardiff, shareDifficulty, time.Now())
+		if ok {
+			m.setDifficulty(e, context.clampDifficulty(diff))
+		}
+	}
 	return nil
 }
 
+// NtimePolicy bounds the ntime rolled by miners relative to job ntime.
+type NtimePolicy struct {
+	MaxAhead  Duration
+	MaxBehind Duration
+}
+
+// verify returns seconds ntime deviates from job ntime, ok is false if
+// ntime is out of the bounds, or too far from wall clock.
+func (np *NtimePolicy) verify(job *Job, ntime, now int64) (offset int64, ok bool) {
+	jobNtime, err := HexToInt64(job.Ntime)
+	if err != nil {
+		return 0, false
+	}
+	offset = ntime - jobNtime
+	if offset > int64(time.Duration(np.MaxAhead).Seconds()) ||
+		-offset > int64(time.Duration(np.MaxBehind).Seconds()) {
+		return offset, false
+	}
+	if ntime > now+int64(MaxNtimeDrift.Seconds()) {
+		return offset, false
+	}
+	return offset, true
+}
+
+// DifficultyToTarget supports fractional difficulty, eg: 0.0001 for x11.
+func DifficultyToTarget(diff float64) *big.Int {
+	return SHA256.Target(diff)
+}
+
+func TargetToDifficulty(target *big.Int) float64 {
+	return SHA256.Difficulty(target)
+}
+
 func DiffToTarget(diff int64) *big.Int {
 	// diff1 := 0x00000000FFFF0000000000000000000000000000000000000000000000000000
 	compact := uint32(0x1d00ffff)
@@ -256,6 +608,7 @@ type NonceCounter interface {
 	Next() string
 	Nonce2Size() int
 	Nonce1Suffix(string) string
+	Utilization() float64
 }
 
 type ExtraNonceCounter struct {
@@ -295,6 +648,13 @@ func (ct *ExtraNonceCounter) Nonce1Suffix(nonce1 string) string {
 	return ""
 }
 
+// Utilization is the ratio of extranonce1 space issued.
+func (ct *ExtraNonceCounter) Utilization() float64 {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	return float64(ct.count) / math.Pow(2, float64(ct.Size*8))
+}
+
 // Logic should be the same as tail_iterator in stratum-mining-proxy
 //
 // # Proxypool #
@@ -366,6 +726,41 @@ func (ct *ProxyExtraNonceCounter) Nonce1Suffix(nonce1 string) string {
 	return strings.TrimPrefix(nonce1, ct.extraNonce1)
 }
 
+// Utilization is the ratio of client nonces issued, clients beyond
+// maxClients share nonces with earlier ones.
+func (ct *ProxyExtraNonceCounter) Utilization() float64 {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	return float64(ct.count) / float64(ct.maxClients)
+}
+
+// JobIdCounter issues proxy job ids for a single pool generation.
+//
+// Workers never see the upstream job id, the pool id and generation are
+// encoded into the prefix so a job id issued by one pool (or by a previous
+// connection to the same pool) can not be found in another pool's job list.
+// Generation and counter are fixed width and never wrap in practice, a
+// stale job id never resolves to a new job.
+type JobIdCounter struct {
+	lock   sync.Mutex
+	count  uint32
+	prefix string
+}
+
+func NewJobIdCounter(poolId uint64, generation uint32) *JobIdCounter {
+	return &JobIdCounter{
+		prefix: fmt.Sprintf("%x%08x", poolId, generation),
+	}
+}
+
+func (ct *JobIdCounter) Next() string {
+	ct.lock.Lock()
+	count := ct.count
+	ct.count += 1
+	ct.lock.Unlock()
+	return fmt.Sprintf("%s%08x", ct.prefix, count)
+}
+
 // job_id - ID of the job. Use this ID while submitting share generated from this job.
 // prevhash - Hash of previous block.
 // coinb1 - Initial part of coinbase transaction.
@@ -386,8 +781,11 @@ type Job struct {
 	Ntime        string
 	CleanJobs    bool
 
-	lock   sync.Mutex
-	shares map[string]bool
+	// job id assigned by upstream pool, JobId is the proxy job id when
+	// the job is remapped by pool.
+	UpstreamJobId string
+
+	shares *ShareSet
 }
 
 func NewJob(list birpc.List) (*Job, error) {
@@ -406,11 +804,29 @@ func NewJob(list birpc.List) (*Job, error) {
 		Nbits:        list[6].(string),
 		Ntime:        list[7].(string),
 		CleanJobs:    list[8].(bool),
-		shares:       make(map[string]bool),
+		shares:       NewShareSet(),
 	}
+	job.UpstreamJobId = job.JobId
 	return job, nil
 }
 
+// remap returns a copy of the job under proxy job id.
+func (job *Job) remap(jobId string) *Job {
+	return &Job{
+		JobId:         jobId,
+		PrevHash:      job.PrevHash,
+		Coinb1:        job.Coinb1,
+		Coinb2:        job.Coinb2,
+		MerkleBranch:  job.MerkleBranch,
+		Version:       job.Version,
+		Nbits:         job.Nbits,
+		Ntime:         job.Ntime,
+		CleanJobs:     job.CleanJobs,
+		UpstreamJobId: job.UpstreamJobId,
+		shares:        NewShareSet(),
+	}
+}
+
 func MerkleHashesFromList(list interface{}) ([]*btcwire.ShaHash, error) {
 	hashList := list.(birpc.List)
 	merkleBranches := make([]*btcwire.ShaHash, len(hashList))
@@ -443,13 +859,10 @@ func (job *Job) tolist() *birpc.List {
 	}
 }
 
-func (job *Job) submit(share string) error {
-	if _, ok := job.shares[share]; ok {
+func (job *Job) submit(extraNonce1, extraNonce2, ntime, nonce, version string) error {
+	if !job.shares.Add(extraNonce1, extraNonce2, ntime, nonce, version) {
 		return errors.New("duplicated share")
 	}
-	job.lock.Lock()
-	job.shares[share] = true
-	job.lock.Unlock()
 	return nil
 }
 
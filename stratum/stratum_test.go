@@ -3,10 +3,19 @@ package stratum_test
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
 	"github.com/conformal/btcwire"
 	"github.com/yinhm/ninepool/birpc"
 	"github.com/yinhm/ninepool/stratum"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestExtraNonceCounter(t *testing.T) {
@@ -279,3 +288,480 @@ func TestBuildMerkleRootFromBranches(t *testing.T) {
 		t.Errorf("unexpected merkle root: %v", merkleRoot.String())
 	}
 }
+
+func TestShareSet(t *testing.T) {
+	shares := stratum.NewShareSet()
+	if !shares.Add("080000010000", "0001", "504e86ed", "b2957c02", "00000002") {
+		t.Errorf("new share rejected")
+	}
+	if shares.Add("080000010000", "0001", "504e86ed", "b2957c02", "00000002") {
+		t.Errorf("duplicated share accepted")
+	}
+	if shares.Add("080000010000", "0001", "504E86ED", "B2957C02", "00000002") {
+		t.Errorf("duplicated share in upper case accepted")
+	}
+	if !shares.Add("080000010001", "0001", "504e86ed", "b2957c02", "00000002") {
+		t.Errorf("share from another extranonce1 rejected")
+	}
+	if !shares.Add("080000010000", "0001", "504e86ed", "b2957c02", "00002002") {
+		t.Errorf("share with rolled version rejected")
+	}
+	if shares.Len() != 3 {
+		t.Errorf("incorrect share count %d != 3", shares.Len())
+	}
+}
+
+func TestShareSetConcurrent(t *testing.T) {
+	shares := stratum.NewShareSet()
+
+	var accepted int32
+	var wg sync.WaitGroup
+	for i := 0; i < 1000; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if shares.Add("080000010000", "0001", "504e86ed", "b2957c02", "00000002") {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 1 {
+		t.Errorf("duplicated share accepted %d times", accepted)
+	}
+}
+
+func BenchmarkShareSetParallel(b *testing.B) {
+	shares := stratum.NewShareSet()
+
+	var submitter uint32
+	// thousands of concurrent submitters, each on its own extranonce1
+	b.SetParallelism(1000)
+	b.RunParallel(func(pb *testing.PB) {
+		nonce1 := fmt.Sprintf("08000001%04x", atomic.AddUint32(&submitter, 1))
+		var nonce uint32
+		for pb.Next() {
+			nonce++
+			shares.Add(nonce1, "0001", "504e86ed", fmt.Sprintf("%08x", nonce), "00000002")
+		}
+	})
+}
+
+func TestRollVersion(t *testing.T) {
+	version, err := stratum.RollVersion("20000000", "1fffe000", 0x1fffe000)
+	if err != nil || version != "3fffe000" {
+		t.Errorf("failed to roll version: %v %v", version, err)
+	}
+
+	_, err = stratum.RollVersion("20000000", "00000001", 0x1fffe000)
+	if err == nil {
+		t.Errorf("version bits out of mask should fail")
+	}
+}
+
+func TestDifficultyToTarget(t *testing.T) {
+	if stratum.DifficultyToTarget(1).Cmp(stratum.DiffToTarget(1)) != 0 {
+		t.Errorf("difficulty 1 target mismatch")
+	}
+
+	target := stratum.DifficultyToTarget(0.0001)
+	if diff := stratum.TargetToDifficulty(target); diff < 0.000099 || diff > 0.000101 {
+		t.Errorf("incorrect difficulty from target: %v", diff)
+	}
+}
+
+func TestParseListener(t *testing.T) {
+	lo, err := stratum.ParseListener("sha256@:3336/512/64/4096")
+	if err != nil {
+		t.Fatalf("Failed to parse listener: %s", err)
+	}
+	if lo.Algorithm != "sha256" || lo.Address != ":3336" || lo.Difficulty != 512 ||
+		lo.MinDifficulty != 64 || lo.MaxDifficulty != 4096 {
+		t.Fatalf("Unexpected listener: %+v", lo)
+	}
+
+	lo, err = stratum.ParseListener(":3337")
+	if err != nil || lo.Algorithm != "sha256" || lo.Difficulty != 0 {
+		t.Fatalf("Listener should default to sha256: %+v, %v", lo, err)
+	}
+
+	for _, value := range []string{"foo@:3335", "sha256@", "sha256@:3335/abc", "sha256@:3335/1/10/5"} {
+		if _, err := stratum.ParseListener(value); err == nil {
+			t.Fatalf("Listener %s should be invalid.", value)
+		}
+	}
+}
+
+func TestVardiff(t *testing.T) {
+	options := &stratum.VardiffOptions{
+		TargetTime:   10 * time.Second,
+		RetargetTime: 60 * time.Second,
+		Variance:     30,
+	}
+	start := time.Now()
+	var vd stratum.Vardiff
+	vd.Reset(start)
+
+	// a share every second, 10 times faster than target
+	for i := 1; i < 60; i++ {
+		if _, ok := vd.Retarget(options, 8, start.Add(time.Duration(i)*time.Second)); ok {
+			t.Fatalf("Should not retarget before retarget time.")
+		}
+	}
+	diff, ok := vd.Retarget(options, 8, start.Add(60*time.Second))
+	if !ok || diff != 8*stratum.MaxRetargetRatio {
+		t.Fatalf("Difficulty should rise at most by max ratio: %v, %v", diff, ok)
+	}
+
+	// a share every 10 seconds, on target
+	start = start.Add(60 * time.Second)
+	for i := 1; i <= 6; i++ {
+		diff, ok = vd.Retarget(options, 32, start.Add(time.Duration(i*10)*time.Second))
+	}
+	if ok {
+		t.Fatalf("Should not retarget within variance: %v", diff)
+	}
+
+	// a share every 20 seconds, half target
+	start = start.Add(60 * time.Second)
+	for i := 1; i <= 3; i++ {
+		diff, ok = vd.Retarget(options, 32, start.Add(time.Duration(i*20)*time.Second))
+	}
+	if !ok || diff != 16 {
+		t.Fatalf("Difficulty should drop by half: %v, %v", diff, ok)
+	}
+}
+
+func TestBanList(t *testing.T) {
+	bans, err := stratum.NewBanList([]string{"10.0.0.1", "192.168.1.0/24", "1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1"})
+	if err != nil {
+		t.Fatalf("Failed to create ban list: %s", err)
+	}
+
+	banned := map[string]bool{
+		"10.0.0.1:3335":   true,
+		"10.0.0.2:3335":   false,
+		"192.168.1.77:80": true,
+		"192.168.2.77:80": false,
+	}
+	for addr, expected := range banned {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		if bans.BannedAddr(tcpAddr) != expected {
+			t.Fatalf("Ban of %s should be %v", addr, expected)
+		}
+	}
+	if !bans.BannedAddress("1HLoD9E4SDFFPDiYfNYnkBLQ85Y51J3Zb1") {
+		t.Fatalf("Address should be banned.")
+	}
+
+	if _, err := stratum.NewBanList([]string{"10.0.0.0/33"}); err == nil {
+		t.Fatalf("Invalid network should fail.")
+	}
+}
+
+const CONFIG = `{
+	"Listeners": [
+		{"Address": ":3335", "Algorithm": "sha256", "Difficulty": 512},
+		{"Address": ":3336", "Vardiff": {"TargetTime": "20s", "RetargetTime": "2m", "Variance": 25}}
+	],
+	"Orders": [
+		{"Id": 7, "Algorithm": "sha256", "Hostname": "localhost", "Port": "3333", "Username": "user", "Password": "x", "Price": 5000000}
+	],
+	"Vardiff": {"TargetTime": "10s", "RetargetTime": "1m", "Variance": 30},
+	"Bans": ["10.0.0.1"],
+	"Timeouts": {"Subscribe": "5s"}
+}`
+
+func writeConfig(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatalf("Failed to write config: %s", err)
+	}
+	defer file.Close()
+	file.WriteString(content)
+	return file.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	config, err := stratum.LoadConfig(writeConfig(t, CONFIG))
+	if err != nil {
+		t.Fatalf("Failed to load config: %s", err)
+	}
+
+	var options stratum.Options
+	config.Apply(&options)
+	if options.SubscribeTimeout != 5*time.Second || len(options.Orders) != 1 ||
+		options.Orders[0].Price != 5000000 || len(options.Bans) != 1 {
+		t.Fatalf("Unexpected options: %+v", options)
+	}
+	if len(options.Listeners) != 2 || options.Listeners[0].Difficulty != 512 ||
+		options.Listeners[1].Algorithm != "sha256" ||
+		options.Listeners[1].Vardiff.TargetTime != 20*time.Second {
+		t.Fatalf("Unexpected listeners: %+v", options.Listeners)
+	}
+	if options.Vardiff.RetargetTime != time.Minute {
+		t.Fatalf("Unexpected vardiff: %+v", options.Vardiff)
+	}
+
+	// explicit zero bound is kept, unset bound falls back to default
+	config, err = stratum.LoadConfig(writeConfig(t, `{"NtimeMaxAhead": "0s",
+		"Orders": [{"Id": 1, "Hostname": "localhost", "Port": "3333", "Username": "x",
+			"NtimePolicy": {"MaxAhead": "10m", "MaxBehind": "1m"}}]}`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %s", err)
+	}
+	options = stratum.Options{}
+	config.Apply(&options)
+	if options.Ntime == nil || options.Ntime.MaxAhead != 0 ||
+		time.Duration(options.Ntime.MaxBehind) != stratum.DefaultNtimeMaxBehind {
+		t.Fatalf("Unexpected ntime policy: %+v", options.Ntime)
+	}
+	if np := options.Orders[0].NtimePolicy; time.Duration(np.MaxAhead) != 10*time.Minute ||
+		time.Duration(np.MaxBehind) != time.Minute {
+		t.Fatalf("Unexpected order ntime policy: %+v", np)
+	}
+
+	invalid := []string{
+		`{"Listeners": [{"Address": ":3335", "Algorithm": "foo"}]}`,
+		`{"Listeners": [{"Address": ":3335"}, {"Address": ":3335"}]}`,
+		`{"Orders": [{"Id": 1, "Hostname": "localhost", "Port": "3333"}]}`,
+		`{"Bans": ["10.0.0.0/33"]}`,
+		`{"Timeouts": {"Subscribe": 5}}`,
+		`{"Fees": {"Base": 0.002, "Vip": 1.5}}`,
+		`{"VipCapRatio": 2}`,
+		`{"NtimeMaxBehind": "-1s"}`,
+		`{"Orders": [{"Id": 1, "Hostname": "localhost", "Port": "3333", "Username": "x", "NtimePolicy": {"MaxAhead": 3600}}]}`,
+		`{"Orders": [{"Id": 1, "Hostname": "localhost", "Port": "3333", "Username": "x", "Price": 10, "MaxPrice": 5}]}`,
+	}
+	for _, content := range invalid {
+		if _, err := stratum.LoadConfig(writeConfig(t, content)); err == nil {
+			t.Fatalf("Config should be invalid: %s", content)
+		}
+	}
+}
+
+func TestHashrateEstimator(t *testing.T) {
+	start := time.Now()
+	rate := stratum.NewHashrateEstimator(stratum.SHA256, 10*time.Minute, start)
+	expected := stratum.SHA256.HashesPerShare() // a share of diff 1 per second
+
+	near := func(name string, got, expected, tolerance float64) {
+		if math.Abs(got-expected) > expected*tolerance {
+			t.Fatalf("%s hashrate %g, expected %g", name, got, expected)
+		}
+	}
+
+	now := start
+	for i := 0; i < 2*3600; i++ {
+		now = now.Add(time.Second)
+		rate.Add(1, now)
+		if i == 60 {
+			// young estimator scaled to elapsed time
+			hashrate := rate.Hashrate(now)
+			near("young ema", hashrate.EMA, expected, 0.05)
+			near("young 1h", hashrate.H1, expected, 0.05)
+		}
+	}
+	hashrate := rate.Hashrate(now)
+	near("ema", hashrate.EMA, expected, 0.01)
+	near("5m", hashrate.M5, expected, 0.05)
+	near("1h", hashrate.H1, expected, 0.05)
+
+	// miner gone for 20 minutes
+	now = now.Add(20 * time.Minute)
+	hashrate = rate.Hashrate(now)
+	near("decayed ema", hashrate.EMA, expected*math.Exp(-2), 0.01)
+	if hashrate.M5 != 0 {
+		t.Fatalf("5m hashrate should be zero, got %g", hashrate.M5)
+	}
+	near("1h after 20m", hashrate.H1, expected*2/3, 0.05)
+}
+
+func TestShareLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sharelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shares, err := stratum.OpenShareLog(dir, 600)
+	if err != nil {
+		t.Fatalf("Failed to open share log: %s", err)
+	}
+	day := time.Date(2014, 6, 1, 12, 0, 0, 0, time.Local)
+	record := func(i int, worker string) *stratum.ShareRecord {
+		return &stratum.ShareRecord{
+			Time:       day.Add(time.Duration(i) * time.Minute),
+			Worker:     worker,
+			Order:      1,
+			Difficulty: 16,
+			Hash:       fmt.Sprintf("%064x", i),
+			Result:     "accepted",
+			Upstream:   stratum.UpstreamPending,
+		}
+	}
+	for i := 0; i < 6; i++ {
+		shares.Append(record(i, []string{"w1", "w2"}[i%2]))
+	}
+	accepted := record(0, "w1")
+	accepted.Upstream = stratum.UpstreamAccepted
+	shares.Append(accepted)
+	rejected := record(1, "w2")
+	rejected.Upstream = stratum.UpstreamRejected
+	rejected.UpstreamError = "Share rejected."
+	shares.Append(rejected)
+	shares.Append(&stratum.ShareRecord{
+		Time:   day.Add(24 * time.Hour),
+		Worker: "w1",
+		Order:  1,
+		Result: "stale",
+		Reason: "job_not_found",
+	})
+	if err := shares.Flush(); err != nil {
+		t.Fatalf("Failed to flush: %s", err)
+	}
+
+	rotated, _ := filepath.Glob(filepath.Join(dir, "shares-*.log"))
+	if len(rotated) < 2 {
+		t.Fatalf("Share log not rotated: %v", rotated)
+	}
+
+	records, err := shares.Query(&stratum.ShareQuery{})
+	if err != nil {
+		t.Fatalf("Failed to query: %s", err)
+	}
+	if len(records) != 7 {
+		t.Fatalf("Expected 7 shares, got %d", len(records))
+	}
+	if records[0].Upstream != stratum.UpstreamAccepted ||
+		records[1].Upstream != stratum.UpstreamRejected || records[1].UpstreamError == "" ||
+		records[2].Upstream != stratum.UpstreamPending {
+		t.Fatalf("Upstream results not merged: %+v %+v %+v", records[0], records[1], records[2])
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].Time.Before(records[i-1].Time) {
+			t.Fatalf("Shares not in time order.")
+		}
+	}
+
+	for _, test := range []struct {
+		query    stratum.ShareQuery
+		expected int
+	}{
+		{stratum.ShareQuery{Worker: "w1"}, 4},
+		{stratum.ShareQuery{Order: 2}, 0},
+		{stratum.ShareQuery{Result: "stale"}, 1},
+		{stratum.ShareQuery{Since: day.Add(24 * time.Hour)}, 1},
+		{stratum.ShareQuery{Since: day.Add(time.Minute), Until: day.Add(3 * time.Minute)}, 2},
+		{stratum.ShareQuery{Limit: 2}, 2},
+	} {
+		records, err := shares.Query(&test.query)
+		if err != nil || len(records) != test.expected {
+			t.Fatalf("Query %+v expected %d shares, got %d, %v", test.query, test.expected, len(records), err)
+		}
+	}
+	// the last shares in time order
+	last, _ := shares.Query(&stratum.ShareQuery{Limit: 2})
+	if !last[0].Time.Equal(records[5].Time) || last[1].Result != "stale" {
+		t.Fatalf("Expected the last 2 shares, got %+v %+v", last[0], last[1])
+	}
+
+	// reopened log appends to current file
+	shares.Close()
+	shares, err = stratum.OpenShareLog(dir, 600)
+	if err != nil {
+		t.Fatalf("Failed to reopen share log: %s", err)
+	}
+	shares.Append(record(7, "w2"))
+	records, _ = shares.Query(&stratum.ShareQuery{})
+	if len(records) != 8 {
+		t.Fatalf("Expected 8 shares after reopen, got %d", len(records))
+	}
+	shares.Close()
+}
+
+func TestLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, stratum.LedgerName)
+
+	ledger, err := stratum.NewLedger(path, 1000, stratum.DefaultFeeSchedule())
+	if err != nil {
+		t.Fatalf("Failed to create ledger: %s", err)
+	}
+	order := &stratum.Order{Id: 1}
+	vip := &stratum.Order{Id: 2, Vip: true}
+	for i := 0; i < 4; i++ {
+		ledger.Credit(order, "seller1", 500)
+	}
+	ledger.Credit(vip, "seller2", 800)
+
+	seller1, ok := ledger.Account("seller1")
+	fee := 2000 * stratum.DefaultFeeRate
+	if !ok || seller1.Shares != 4 || math.Abs(seller1.Balance-(2000-fee)) > 1e-9 {
+		t.Fatalf("Unexpected seller account: %+v", seller1)
+	}
+	bill, ok := ledger.Bill(2)
+	if !ok || bill.FeeRate != stratum.DefaultVipFeeRate || math.Abs(bill.Fee-3.2) > 1e-9 ||
+		math.Abs(bill.Credited-796.8) > 1e-9 {
+		t.Fatalf("Unexpected VIP order bill: %+v", bill)
+	}
+
+	due := ledger.Due()
+	if len(due) != 1 || due[0].Address != "seller1" || due[0].Amount != 1996 {
+		t.Fatalf("Only seller1 over threshold expected: %+v", due)
+	}
+
+	payout, err := ledger.CreatePayout()
+	if err != nil || payout == nil || payout.Id != 1 || payout.Total != 1996 {
+		t.Fatalf("Unexpected payout: %+v, %v", payout, err)
+	}
+	var buf bytes.Buffer
+	payout.WriteCSV(&buf)
+	if buf.String() != "address,amount\nseller1,1996\n" {
+		t.Fatalf("Unexpected csv: %q", buf.String())
+	}
+	if payout, _ := ledger.CreatePayout(); payout != nil {
+		t.Fatalf("Balance paid twice: %+v", payout)
+	}
+
+	// payout saved at once, credits on flush
+	ledger.Credit(order, "seller2", 300)
+	if err := ledger.Flush(); err != nil {
+		t.Fatalf("Failed to flush ledger: %s", err)
+	}
+	ledger, err = stratum.NewLedger(path, 1000, stratum.DefaultFeeSchedule())
+	if err != nil {
+		t.Fatalf("Failed to load ledger: %s", err)
+	}
+	seller1, _ = ledger.Account("seller1")
+	seller2, _ := ledger.Account("seller2")
+	if seller1.Paid != 1996 || seller1.Balance >= 1 || seller2.Shares != 2 ||
+		len(ledger.Payouts()) != 1 {
+		t.Fatalf("Ledger not persisted: %+v %+v", seller1, seller2)
+	}
+	due = ledger.Due()
+	if len(due) != 1 || due[0].Address != "seller2" || due[0].Amount != 1096 {
+		t.Fatalf("Unexpected due after reload: %+v", due)
+	}
+	if bill, _ := ledger.Bill(1); math.Abs(bill.Spent-2300) > 1e-9 || math.Abs(bill.Fee-4.6) > 1e-9 {
+		t.Fatalf("Order bill not persisted: %+v", bill)
+	}
+
+	// new rates apply to later spend only
+	ledger.SetFees(stratum.FeeSchedule{Base: 0.01, Vip: 0.02})
+	ledger.Credit(vip, "seller2", 100)
+	if bill, _ := ledger.Bill(2); bill.FeeRate != 0.02 || math.Abs(bill.Fee-5.2) > 1e-9 {
+		t.Fatalf("Unexpected bill after fee change: %+v", bill)
+	}
+
+	// no order, credited at base rate without a bill
+	ledger.Credit(nil, "seller3", 100)
+	if seller3, _ := ledger.Account("seller3"); math.Abs(seller3.Balance-99) > 1e-9 {
+		t.Fatalf("Unexpected account credited without order: %+v", seller3)
+	}
+}
@@ -0,0 +1,488 @@
+// Package stratumtest provides a fake stratum pool served in process, end
+// to end tests of the proxy run offline against it.
+package stratumtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Errors returned by authorize and submit policies.
+var (
+	ErrReject     = errors.New("Rejected.")     // replied with result false
+	ErrDisconnect = errors.New("Disconnected.") // connection closed instead of reply
+)
+
+// Error is replied with its code instead of the default code of method.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Share submitted to pool.
+type Share struct {
+	Username    string
+	JobId       string
+	ExtraNonce2 string
+	Ntime       string
+	Nonce       string
+	VersionBits string // empty if version not rolled
+	Accepted    bool
+}
+
+// Job is template of jobs notified, job ids are assigned by pool.
+type Job struct {
+	PrevHash     string
+	Coinb1       string
+	Coinb2       string
+	MerkleBranch []string
+	Version      string
+	NBits        string
+	NTime        string
+}
+
+// DefaultJob is a block template of testnet.
+var DefaultJob = Job{
+	PrevHash:     "4d16b6f85af6e2198f44ae2a6de67f78487ae5611b77c6c0440b921e00000000",
+	Coinb1:       "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff20020862062f503253482f04b8864e5008",
+	Coinb2:       "072f736c7573682f000000000100f2052a010000001976a914d23fcdf86f7e756a64a7a9688ef9903327048ed988ac00000000",
+	MerkleBranch: []string{},
+	Version:      "00000002",
+	NBits:        "1c2ac4af",
+	NTime:        "504e86b9",
+}
+
+type Options struct {
+	ExtraNonce2Size int           // 4 if 0
+	VersionMask     uint32        // version rolling disabled if 0
+	Difficulty      float64       // sent before first job, 1 if 0
+	Job             *Job          // DefaultJob if nil
+	JobInterval     time.Duration // period of new jobs, 0 never
+	ManualJobs      bool          // no job on authorize, only on Notify
+
+	// Policies, nil accepts all. Error other than ErrReject and
+	// ErrDisconnect is replied as error, with code of Error if given.
+	Authorize func(username, password string) error
+	Submit    func(share *Share) error
+}
+
+// Pool is a fake stratum pool listening on a local port, or serving
+// connections given.
+type Pool struct {
+	opts     Options
+	listener net.Listener
+	done     chan struct{}
+
+	lock     sync.Mutex
+	conns    map[*conn]bool
+	connects int
+	nonce1   uint32
+	jobSeq   uint64
+	jobId    string
+	shares   []Share
+	closed   bool
+}
+
+type conn struct {
+	net.Conn
+	wlock      sync.Mutex
+	authorized bool // guarded by pool lock
+}
+
+type request struct {
+	Id     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params []interface{}   `json:"params"`
+}
+
+type response struct {
+	Id     json.RawMessage `json:"id"`
+	Result interface{}     `json:"result"`
+	Error  interface{}     `json:"error"`
+}
+
+type notification struct {
+	Id     interface{}   `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+// NewUnstartedPool returns pool serving only connections given to
+// ServeConn.
+func NewUnstartedPool(opts Options) *Pool {
+	if opts.ExtraNonce2Size == 0 {
+		opts.ExtraNonce2Size = 4
+	}
+	if opts.Difficulty == 0 {
+		opts.Difficulty = 1
+	}
+	if opts.Job == nil {
+		opts.Job = &DefaultJob
+	}
+	p := &Pool{
+		opts:   opts,
+		done:   make(chan struct{}),
+		conns:  make(map[*conn]bool),
+		nonce1: 0x08000001,
+	}
+	if opts.JobInterval > 0 {
+		go p.jobLoop()
+	}
+	return p
+}
+
+// NewPool returns pool listening on a local port, panics if failed to
+// listen.
+func NewPool(opts Options) *Pool {
+	p := NewUnstartedPool(opts)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("stratumtest: failed to listen: %v", err))
+	}
+	p.listener = ln
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.ServeConn(c)
+		}
+	}()
+	return p
+}
+
+// Addr returns host:port listened, empty if unstarted.
+func (p *Pool) Addr() string {
+	if p.listener == nil {
+		return ""
+	}
+	return p.listener.Addr().String()
+}
+
+func (p *Pool) Host() string {
+	host, _, _ := net.SplitHostPort(p.Addr())
+	return host
+}
+
+func (p *Pool) Port() string {
+	_, port, _ := net.SplitHostPort(p.Addr())
+	return port
+}
+
+// ServeConn serves stratum on c until closed.
+func (p *Pool) ServeConn(c net.Conn) {
+	sc := &conn{Conn: c}
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		c.Close()
+		return
+	}
+	p.conns[sc] = true
+	p.connects += 1
+	p.lock.Unlock()
+
+	defer func() {
+		p.lock.Lock()
+		delete(p.conns, sc)
+		p.lock.Unlock()
+		c.Close()
+	}()
+
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return
+		}
+		if req.Method == "" || string(req.Id) == "" || string(req.Id) == "null" {
+			// reply or notification of client
+			continue
+		}
+		if !p.handle(sc, &req) {
+			return
+		}
+	}
+}
+
+// handle replies request, returns false if connection to be closed.
+func (p *Pool) handle(c *conn, req *request) bool {
+	switch req.Method {
+	case "mining.configure":
+		result := map[string]interface{}{"version-rolling": false}
+		if p.opts.VersionMask != 0 {
+			mask := p.opts.VersionMask
+			if ext, ok := param(req, 1).(map[string]interface{}); ok {
+				if s, ok := ext["version-rolling.mask"].(string); ok {
+					if requested, err := strconv.ParseUint(s, 16, 32); err == nil {
+						mask &= uint32(requested)
+					}
+				}
+			}
+			result["version-rolling"] = true
+			result["version-rolling.mask"] = fmt.Sprintf("%08x", mask)
+		}
+		c.reply(req, result, nil)
+	case "mining.subscribe":
+		p.lock.Lock()
+		p.nonce1 += 1
+		nonce1 := fmt.Sprintf("%08x", p.nonce1)
+		p.lock.Unlock()
+		subscriptions := []interface{}{
+			[]interface{}{"mining.set_difficulty", nonce1},
+			[]interface{}{"mining.notify", nonce1},
+		}
+		c.reply(req, []interface{}{subscriptions, nonce1, p.opts.ExtraNonce2Size}, nil)
+	case "mining.authorize":
+		username, _ := param(req, 0).(string)
+		password, _ := param(req, 1).(string)
+		var err error
+		if p.opts.Authorize != nil {
+			err = p.opts.Authorize(username, password)
+		}
+		if !c.replyPolicy(req, err, 24) {
+			return false
+		}
+		if err == nil {
+			p.lock.Lock()
+			c.authorized = true
+			p.lock.Unlock()
+			if !p.opts.ManualJobs {
+				p.lock.Lock()
+				diff := p.opts.Difficulty
+				p.lock.Unlock()
+				c.notify("mining.set_difficulty", diff)
+				c.notify("mining.notify", p.job(true)...)
+			}
+		}
+	case "mining.submit":
+		share := &Share{}
+		share.Username, _ = param(req, 0).(string)
+		share.JobId, _ = param(req, 1).(string)
+		share.ExtraNonce2, _ = param(req, 2).(string)
+		share.Ntime, _ = param(req, 3).(string)
+		share.Nonce, _ = param(req, 4).(string)
+		share.VersionBits, _ = param(req, 5).(string)
+		var err error
+		if p.opts.Submit != nil {
+			err = p.opts.Submit(share)
+		}
+		share.Accepted = err == nil
+		p.lock.Lock()
+		p.shares = append(p.shares, *share)
+		p.lock.Unlock()
+		return c.replyPolicy(req, err, 23)
+	case "mining.suggest_difficulty", "mining.extranonce.subscribe":
+		c.reply(req, true, nil)
+	default:
+		c.reply(req, nil, []interface{}{20, "Method not found", nil})
+	}
+	return true
+}
+
+func param(req *request, i int) interface{} {
+	if i >= len(req.Params) {
+		return nil
+	}
+	return req.Params[i]
+}
+
+// replyPolicy replies request by policy error, returns false if
+// connection to be closed.
+func (c *conn) replyPolicy(req *request, err error, code int) bool {
+	switch err {
+	case nil:
+		c.reply(req, true, nil)
+	case ErrReject:
+		c.reply(req, false, nil)
+	case ErrDisconnect:
+		return false
+	default:
+		if e, ok := err.(*Error); ok {
+			code = e.Code
+		}
+		c.reply(req, nil, []interface{}{code, err.Error(), nil})
+	}
+	return true
+}
+
+func (c *conn) reply(req *request, result, err interface{}) {
+	c.write(&response{Id: req.Id, Result: result, Error: err})
+}
+
+func (c *conn) notify(method string, params ...interface{}) {
+	c.write(&notification{Method: method, Params: params})
+}
+
+func (c *conn) write(msg interface{}) {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.Write(append(buf, '\n'))
+}
+
+// job returns params of mining.notify of a new job.
+func (p *Pool) job(clean bool) []interface{} {
+	p.lock.Lock()
+	p.jobSeq += 1
+	p.jobId = strconv.FormatUint(p.jobSeq, 16)
+	jobId := p.jobId
+	p.lock.Unlock()
+
+	t := p.opts.Job
+	branch := make([]interface{}, len(t.MerkleBranch))
+	for i, hash := range t.MerkleBranch {
+		branch[i] = hash
+	}
+	return []interface{}{jobId, t.PrevHash, t.Coinb1, t.Coinb2, branch,
+		t.Version, t.NBits, t.NTime, clean}
+}
+
+func (p *Pool) jobLoop() {
+	ticker := time.NewTicker(p.opts.JobInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.Notify(false)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// authorized returns connections authorized.
+func (p *Pool) authorized() []*conn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	conns := make([]*conn, 0, len(p.conns))
+	for c := range p.conns {
+		if c.authorized {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// Notify sends a new job to connections authorized, clean if previous
+// jobs are invalid.
+func (p *Pool) Notify(clean bool) {
+	params := p.job(clean)
+	for _, c := range p.authorized() {
+		c.notify("mining.notify", params...)
+	}
+}
+
+// SetDifficulty sends difficulty to connections authorized, applied from
+// next job.
+func (p *Pool) SetDifficulty(diff float64) {
+	p.lock.Lock()
+	p.opts.Difficulty = diff
+	p.lock.Unlock()
+	for _, c := range p.authorized() {
+		c.notify("mining.set_difficulty", diff)
+	}
+}
+
+// SetVersionMask sends mining.set_version_mask to authorized connections,
+// mask also replied to later mining.configure.
+func (p *Pool) SetVersionMask(mask uint32) {
+	p.lock.Lock()
+	p.opts.VersionMask = mask
+	p.lock.Unlock()
+	for _, c := range p.authorized() {
+		c.notify("mining.set_version_mask", fmt.Sprintf("%08x", mask))
+	}
+}
+
+// Reconnect sends client.reconnect to all connections, empty host and 0
+// port reconnect to same pool.
+func (p *Pool) Reconnect(host string, port int, wait int) {
+	p.lock.Lock()
+	conns := make([]*conn, 0, len(p.conns))
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.lock.Unlock()
+	for _, c := range conns {
+		c.notify("client.reconnect", host, port, wait)
+	}
+}
+
+// Disconnect closes all connections, pool keeps listening.
+func (p *Pool) Disconnect() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for c := range p.conns {
+		c.Close()
+	}
+}
+
+// Close stops listening and closes all connections.
+func (p *Pool) Close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	p.lock.Unlock()
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.Disconnect()
+}
+
+// JobId returns id of latest job notified.
+func (p *Pool) JobId() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.jobId
+}
+
+// Shares returns shares submitted, oldest first.
+func (p *Pool) Shares() []Share {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]Share(nil), p.shares...)
+}
+
+// Accepted returns count of shares accepted.
+func (p *Pool) Accepted() int {
+	count := 0
+	for _, share := range p.Shares() {
+		if share.Accepted {
+			count += 1
+		}
+	}
+	return count
+}
+
+// Conns returns count of connections open.
+func (p *Pool) Conns() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.conns)
+}
+
+// Connects returns count of connections ever served.
+func (p *Pool) Connects() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.connects
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/conformal/btcwire"
 	"github.com/conformal/fastsha256"
 	"math"
@@ -240,7 +242,12 @@ func BuildMerkleRoot(hashes []*btcwire.ShaHash) *btcwire.ShaHash {
 }
 
 func SerializeHeader(job *Job, merkleRoot *btcwire.ShaHash, ntime string, nonce string) (*btcwire.BlockHeader, error) {
-	Version, err := HexToInt32(job.Version)
+	return SerializeHeaderWithVersion(job, merkleRoot, job.Version, ntime, nonce)
+}
+
+// Serialize header with block version rolled by miner, see RollVersion.
+func SerializeHeaderWithVersion(job *Job, merkleRoot *btcwire.ShaHash, version string, ntime string, nonce string) (*btcwire.BlockHeader, error) {
+	Version, err := HexToUint32(version)
 	if err != nil {
 		return nil, err
 	}
@@ -269,7 +276,7 @@ func SerializeHeader(job *Job, merkleRoot *btcwire.ShaHash, ntime string, nonce
 
 	// https://en.bitcoin.it/wiki/Protocol_specification#Block_Headers
 	header := &btcwire.BlockHeader{
-		Version:    Version,
+		Version:    int32(Version),
 		PrevBlock:  *PrevHash,
 		MerkleRoot: *merkleRoot,
 		Timestamp:  Timestamp,
@@ -279,6 +286,23 @@ func SerializeHeader(job *Job, merkleRoot *btcwire.ShaHash, ntime string, nonce
 	return header, nil
 }
 
+// RollVersion applies version bits submitted by miner to job version, only
+// bits in mask are taken. Returns rolled version in hex.
+func RollVersion(version string, versionBits string, mask uint32) (string, error) {
+	v, err := HexToUint32(version)
+	if err != nil {
+		return "", err
+	}
+	bits, err := HexToUint32(versionBits)
+	if err != nil {
+		return "", err
+	}
+	if bits&^mask != 0 {
+		return "", errors.New("version bits out of mask")
+	}
+	return fmt.Sprintf("%08x", v&^mask|bits&mask), nil
+}
+
 func HeaderToBig(header *btcwire.BlockHeader) *big.Int {
 	headerHash, _ := header.BlockSha()
 	return ShaHashToBig(&headerHash)
@@ -0,0 +1,69 @@
+package stratum
+
+import (
+	"sync"
+	"time"
+)
+
+// VardiffOptions adjusts worker difficulty so that a share is submitted
+// about every TargetTime, zero TargetTime disables vardiff.
+type VardiffOptions struct {
+	TargetTime   time.Duration
+	RetargetTime time.Duration
+	Variance     float64 // percent of TargetTime share interval may vary
+}
+
+// Max ratio difficulty changes by in one retarget.
+const MaxRetargetRatio = 4
+
+// Vardiff counts accepted shares of a worker since last retarget.
+type Vardiff struct {
+	lock   sync.Mutex
+	since  time.Time
+	shares int
+}
+
+// Reset starts a new retarget window, called when difficulty changed.
+func (v *Vardiff) Reset(now time.Time) {
+	v.lock.Lock()
+	v.since = now
+	v.shares = 0
+	v.lock.Unlock()
+}
+
+// Retarget records an accepted share of diff, returns new difficulty when
+// RetargetTime elapsed and share interval is out of variance.
+func (v *Vardiff) Retarget(options *VardiffOptions, diff float64, now time.Time) (float64, bool) {
+	if options.TargetTime <= 0 {
+		return diff, false
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.since.IsZero() {
+		v.since = now
+	}
+	v.shares++
+	elapsed := now.Sub(v.since)
+	if elapsed < options.RetargetTime {
+		return diff, false
+	}
+	v.since = now
+	interval := elapsed.Seconds() / float64(v.shares)
+	v.shares = 0
+
+	target := options.TargetTime.Seconds()
+	variance := target * options.Variance / 100
+	if interval >= target-variance && interval <= target+variance {
+		return diff, false
+	}
+
+	ratio := target / interval
+	if ratio > MaxRetargetRatio {
+		ratio = MaxRetargetRatio
+	} else if ratio < 1.0/MaxRetargetRatio {
+		ratio = 1.0 / MaxRetargetRatio
+	}
+	return diff * ratio, true
+}
@@ -2,8 +2,12 @@ package stratum
 
 import (
 	"errors"
+	"fmt"
 	"github.com/yinhm/ninepool/birpc"
 	"log"
+	"net/rpc"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,9 +17,11 @@ type Worker struct {
 	endpoint     *birpc.Endpoint
 	context      *Context
 	connected    bool // true when subscribed
-	samplePeriod int  // in minutes
+	samplePeriod int  // hashrate moving average time constant, in seconds
 	accepted     int
 	rejected     int
+	lastShare    time.Time
+	rate         *HashrateEstimator
 	created      int64
 	closing      bool
 }
@@ -34,8 +40,10 @@ func NewWorker(endpoint *birpc.Endpoint, timeout time.Duration) *Worker {
 		samplePeriod: 600,
 		created:      time.Now().Unix(),
 	}
+	context.worker = worker
 
 	go worker.waitSubscribe(timeout)
+	go worker.queryVersion(GetVersionTimeout)
 
 	return worker
 }
@@ -55,7 +63,7 @@ func (w *Worker) Close() {
 func (w *Worker) waitSubscribe(timeout time.Duration) {
 	select {
 	case _ = <-w.context.SubCh:
-		err := w.bindFirstPool()
+		err := w.bindBestPool()
 		if err != nil {
 			w.context.PoolCh <- false
 			w.connected = false
@@ -71,8 +79,8 @@ func (w *Worker) waitSubscribe(timeout time.Duration) {
 	}
 }
 
-func (w *Worker) bindFirstPool() error {
-	pool, err := DefaultServer.firstPool()
+func (w *Worker) bindBestPool() error {
+	pool, err := DefaultServer.bestPool(w.context.listener)
 	if err != nil {
 		return err
 	}
@@ -82,19 +90,26 @@ func (w *Worker) bindFirstPool() error {
 
 func (w *Worker) rebind(newPool *Pool) {
 	w.detachPool()
+	w.lock.Lock()
 	w.context.pool = newPool
-	w.context.pool.addWorker(w)
+	w.lock.Unlock()
+	newPool.addWorker(w)
 }
 
 func (w *Worker) detachPool() {
-	if w.context.pool == nil {
+	pool := w.context.pool
+	if pool == nil {
 		return
 	}
-	w.context.pool.removeWorker(w)
+	pool.removeWorker(w)
+	w.lock.Lock()
 	w.context.pool = nil
+	w.lock.Unlock()
 }
 
 func (w *Worker) sendJob(job *Job) {
+	w.context.PrevDifficulty = 0
+
 	var msg birpc.Message
 	msg.ID = 0
 	msg.Func = "mining.notify"
@@ -102,6 +117,137 @@ func (w *Worker) sendJob(job *Job) {
 	w.endpoint.Notify(&msg)
 }
 
+// narrowVersionMask restricts version rolling mask of worker to mask, miner
+// is sent mining.set_version_mask if its mask is not a subset.
+func (w *Worker) narrowVersionMask(mask uint32) {
+	w.lock.Lock()
+	ctx := w.context
+	if !ctx.VersionRolling || ctx.VersionMask&^mask == 0 {
+		w.lock.Unlock()
+		return
+	}
+	ctx.VersionMask &= mask
+	mask = ctx.VersionMask
+	w.lock.Unlock()
+
+	var msg birpc.Message
+	msg.ID = 0
+	msg.Func = "mining.set_version_mask"
+	msg.Args = &birpc.List{fmt.Sprintf("%08x", mask)}
+	w.endpoint.Notify(&msg)
+}
+
+// queryVersion asks miner software and version by client.get_version,
+// miners not supporting it are ignored.
+func (w *Worker) queryVersion(timeout time.Duration) {
+	var version string
+	call := w.endpoint.Go("client.get_version", birpc.List{}, &version, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			log.Printf("client.get_version failed: %s", call.Error)
+			return
+		}
+		w.lock.Lock()
+		w.context.Version = version
+		w.lock.Unlock()
+		log.Printf("Worker running %s", version)
+	case <-time.After(timeout):
+		log.Printf("No client.get_version reply received from worker in %.2f seconds.", timeout.Seconds())
+	}
+}
+
+// MinerVersion returns miner software reported by client.get_version.
+func (w *Worker) MinerVersion() string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.context.Version
+}
+
+// ShowMessage displays a human readable message on miner.
+func (w *Worker) ShowMessage(message string) {
+	var msg birpc.Message
+	msg.ID = 0
+	msg.Func = "client.show_message"
+	msg.Args = &birpc.List{message}
+	w.endpoint.Notify(&msg)
+}
+
+// Reconnect asks miner to reconnect to another host after wait seconds,
+// empty hostname for reconnecting to the same host.
+func (w *Worker) Reconnect(hostname string, port int, wait int) {
+	var msg birpc.Message
+	msg.ID = 0
+	msg.Func = "client.reconnect"
+	msg.Args = &birpc.List{hostname, port, wait}
+	if hostname == "" {
+		msg.Args = &birpc.List{}
+	}
+	w.endpoint.Notify(&msg)
+}
+
+// countShare counts result of share submitted.
+func (w *Worker) countShare(accepted bool, now time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if accepted {
+		w.accepted++
+		w.lastShare = now
+	} else {
+		w.rejected++
+	}
+}
+
+// setListener applies listener profile, hashrate is estimated by algorithm
+// of listener.
+func (w *Worker) setListener(listener *ListenerOptions) {
+	w.context.setListener(listener)
+	tau := time.Duration(w.samplePeriod) * time.Second
+	w.lock.Lock()
+	w.rate = NewHashrateEstimator(w.context.algorithm, tau, time.Now())
+	w.lock.Unlock()
+}
+
+// Hashrate of connection.
+func (w *Worker) Hashrate() Hashrate {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.hashrate()
+}
+
+// hashrate of connection, called with worker locked.
+func (w *Worker) hashrate() Hashrate {
+	if w.rate == nil {
+		return Hashrate{}
+	}
+	return w.rate.Hashrate(time.Now())
+}
+
+func (w *Worker) Stats() *WorkerStats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	ctx := w.context
+	stats := &WorkerStats{
+		Name:         ctx.Username,
+		RemoteAddr:   ctx.RemoteAddress,
+		Difficulty:   ctx.Difficulty,
+		Hashrate:     w.hashrate(),
+		Accepted:     w.accepted,
+		Rejected:     w.rejected,
+		MinerVersion: ctx.Version,
+		Connected:    time.Unix(w.created, 0),
+	}
+	if !w.lastShare.IsZero() {
+		lastShare := w.lastShare
+		stats.LastShare = &lastShare
+	}
+	if pool := ctx.pool; pool != nil {
+		stats.Pool = pool.id
+	}
+	return stats
+}
+
 func (w *Worker) newExtraNonce() {
 
 }
@@ -111,8 +257,36 @@ func (w *Worker) newDifficulty() {
 }
 
 // Update the shares lists with the given share to compute hashrate
-func (w *Worker) updateShareLists() {
+func (w *Worker) updateShareLists(difficulty float64, now time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.rate != nil {
+		w.rate.Add(difficulty, now)
+	}
+}
 
+// parseUsername splits username into payout address and worker name, the
+// difficulty hint in worker name like "addr.d=512" or "addr.rig1.d=512" used
+// by rental platforms is taken out.
+func parseUsername(username string) (address, worker string, diff float64) {
+	parts := strings.Split(username, ".")
+	names := make([]string, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		for _, prefix := range []string{"d=", "diff="} {
+			if strings.HasPrefix(part, prefix) {
+				d, err := strconv.ParseFloat(strings.TrimPrefix(part, prefix), 64)
+				if err == nil && d > 0 {
+					diff = d
+					part = ""
+				}
+				break
+			}
+		}
+		if part != "" {
+			names = append(names, part)
+		}
+	}
+	return parts[0], strings.Join(names, "."), diff
 }
 
 // Stratum connection context, passed to birpc
@@ -121,17 +295,104 @@ type Context struct {
 	SubId           string
 	Username        string
 	Password        string
+	Address         string // payout address in username
+	WorkerName      string // username suffix after address
 	OrderId         uint64
 	Authorized      bool
 	ExtraNonce1     string
 	ExtraNonce2Size int
+	VersionRolling  bool
+	VersionMask     uint32
 	PrevDifficulty  float64
 	Difficulty      float64
+	MinDifficulty   float64
+	MaxDifficulty   float64
+	Suggested       float64 // difficulty suggested by miner
+	Version         string  // miner software, from client.get_version
+	listener        *ListenerOptions
+	worker          *Worker
+	algorithm       *Algorithm
+	vardiff         Vardiff
 	RemoteAddress   string
 	SubCh           chan bool
 	PoolCh          chan bool // pool available
 }
 
+// lock guards fields of context read by Worker.Stats on other goroutines,
+// no-op for contexts of no worker.
+func (ctx *Context) lock() {
+	if ctx.worker != nil {
+		ctx.worker.lock.Lock()
+	}
+}
+
+func (ctx *Context) unlock() {
+	if ctx.worker != nil {
+		ctx.worker.lock.Unlock()
+	}
+}
+
+// setListener applies algorithm and difficulty profile of listener.
+func (ctx *Context) setListener(listener *ListenerOptions) {
+	ctx.listener = listener
+	ctx.algorithm, _ = FindAlgorithm(listener.Algorithm)
+	if ctx.algorithm == nil {
+		ctx.algorithm = SHA256
+	}
+	ctx.MinDifficulty = listener.MinDifficulty
+	ctx.MaxDifficulty = listener.MaxDifficulty
+}
+
+func (ctx *Context) subscribed() bool {
+	return ctx.ExtraNonce1 != ""
+}
+
+// name returns "address.worker" of username, without difficulty hint.
+func (ctx *Context) name() string {
+	if ctx.WorkerName == "" {
+		return ctx.Address
+	}
+	return ctx.Address + "." + ctx.WorkerName
+}
+
+// clampDifficulty bounds difficulty to the limits of listener, and to at
+// least difficulty of upstream pool.
+func (ctx *Context) clampDifficulty(diff float64) float64 {
+	if ctx.MinDifficulty > 0 && diff < ctx.MinDifficulty {
+		diff = ctx.MinDifficulty
+	}
+	if ctx.MaxDifficulty > 0 && diff > ctx.MaxDifficulty {
+		diff = ctx.MaxDifficulty
+	}
+	// never under upstream, shares accepted must be accepted upstream too
+	if ctx.pool != nil {
+		if upstreamDiff := ctx.pool.upstreamDifficulty(); upstreamDiff > diff {
+			diff = upstreamDiff
+		}
+	}
+	return diff
+}
+
+// startDifficulty returns difficulty of newly subscribed worker.
+func (ctx *Context) startDifficulty() float64 {
+	if ctx.Suggested > 0 {
+		return ctx.clampDifficulty(ctx.Suggested)
+	}
+	if ctx.listener != nil && ctx.listener.Difficulty > 0 {
+		return ctx.clampDifficulty(ctx.listener.Difficulty)
+	}
+	return ctx.clampDifficulty(DefaultDifficulty)
+}
+
+// shareDifficulty returns difficulty a share must meet. Shares of previous
+// difficulty still accepted until the next job reaches worker.
+func (ctx *Context) shareDifficulty() float64 {
+	if ctx.PrevDifficulty > 0 && ctx.PrevDifficulty < ctx.Difficulty {
+		return ctx.PrevDifficulty
+	}
+	return ctx.Difficulty
+}
+
 func (ctx *Context) CurrentJob() (*Job, error) {
 	if ctx.pool == nil {
 		return nil, errors.New("no pool avilable")